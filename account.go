@@ -0,0 +1,86 @@
+package dl99
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidUsername    = errors.New("username must be 3 to 20 letters, digits or underscores")
+	ErrWeakPassword       = errors.New("password must be at least 8 characters")
+	ErrUsernameTaken      = errors.New("username already taken")
+	ErrAccountNotFound    = errors.New("account not found")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrSessionNotFound    = errors.New("session not found")
+)
+
+const (
+	minPasswordLength = 8
+
+	DefaultSessionTTL = 7 * 24 * time.Hour
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,20}$`)
+
+// account is a durable identity. It owns exactly one player, which is never
+// deleted, so everything recorded against that player id survives across
+// sessions and restarts. Guests are plain players without an account.
+type account struct {
+	username     string
+	passwordHash []byte
+	playerId     string
+	createdAt    time.Time
+}
+
+type session struct {
+	playerId  string
+	expiresAt time.Time
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < minPasswordLength {
+		return nil, ErrWeakPassword
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func (account *account) checkPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(account.passwordHash, []byte(password)) == nil
+}
+
+type accountRecord struct {
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"password_hash"`
+	PlayerId     string    `json:"player_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (account *account) record() accountRecord {
+	return accountRecord{
+		Username:     account.username,
+		PasswordHash: account.passwordHash,
+		PlayerId:     account.playerId,
+		CreatedAt:    account.createdAt,
+	}
+}
+
+func (record accountRecord) restore() *account {
+	return &account{
+		username:     record.Username,
+		passwordHash: record.PasswordHash,
+		playerId:     record.PlayerId,
+		createdAt:    record.CreatedAt,
+	}
+}
+
+// SetSessionTTL sets how long logins last, sessions already open keep
+// their expiry.
+func (srv *server) SetSessionTTL(ttl time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.sessionTTL = ttl
+}
@@ -0,0 +1,345 @@
+package dl99
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	ErrGamePaused    = errors.New("game paused by an operator")
+	ErrGameNotPaused = errors.New("game not paused")
+)
+
+const (
+	// EventMaintenance carries an operator's notice, see Broadcast.
+	EventMaintenance = "maintenance"
+	// EventGameAborted carries the reason an operator ended the game, see
+	// ForceEndGame. Unlike EventGameFinished there is no archive.
+	EventGameAborted = "game_aborted"
+)
+
+// AdminGame is everything about a game, for operators only, it shows every
+// player's hand.
+type AdminGame struct {
+	Id           string        `json:"id"`
+	Name         string        `json:"name"`
+	State        int           `json:"state"`
+	Paused       bool          `json:"paused"`
+	HostId       string        `json:"host_id"`
+	Private      bool          `json:"private"`
+	InviteCode   string        `json:"invite_code,omitempty"`
+	Score        int           `json:"score"`
+	NextPlayerId string        `json:"next_player_id"`
+	Clockwise    bool          `json:"clock_wise"`
+	Seed         int64         `json:"seed"`
+	Draws        uint64        `json:"draws"`
+	DeckSize     int           `json:"deck_size"`
+	Deck         []string      `json:"deck"`
+	Deadwood     []string      `json:"deadwood"`
+	Players      []AdminPlayer `json:"players"`
+	Participants []string      `json:"participants"`
+	Standings    []string      `json:"standings"`
+	Spectators   []string      `json:"spectators"`
+	Moves        int           `json:"moves"`
+	StartedAt    time.Time     `json:"started_at"`
+	ActiveAt     time.Time     `json:"active_at"`
+}
+
+type AdminPlayer struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Bot      bool     `json:"bot"`
+	GameId   string   `json:"game_id"`
+	Presence string   `json:"presence"`
+	Hand     []string `json:"hand"`
+}
+
+func cardNames(cards []Card) []string {
+	names := make([]string, 0, len(cards))
+	for _, card := range cards {
+		names = append(names, card.Name())
+	}
+	return names
+}
+
+func (srv *server) adminPlayer(player *player) AdminPlayer {
+	return AdminPlayer{
+		Id:       player.id,
+		Name:     player.name,
+		Bot:      player.bot,
+		GameId:   player.gameId,
+		Presence: srv.presenceOf(player.id),
+		Hand:     cardNames(player.hand),
+	}
+}
+
+// AdminGames returns the full state of every game, oldest activity first.
+func (srv *server) AdminGames() ([]AdminGame, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	games, err := srv.store.ListGames()
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]AdminGame, 0, len(games))
+	for _, game := range games {
+		game.mu.Lock()
+		ag := AdminGame{
+			Id:           game.id,
+			Name:         game.name,
+			State:        game.state,
+			Paused:       game.paused,
+			HostId:       game.hostId,
+			Private:      game.private,
+			InviteCode:   game.inviteCode,
+			Score:        game.score,
+			NextPlayerId: game.nextPlayerId,
+			Clockwise:    game.clockwise,
+			Seed:         game.source.seed,
+			Draws:        game.source.draws,
+			DeckSize:     len(game.deck),
+			Deck:         cardNames(game.deck),
+			Deadwood:     cardNames(game.deadwood),
+			Players:      make([]AdminPlayer, 0, len(game.players)),
+			Participants: append([]string{}, game.participants...),
+			Standings:    append([]string{}, game.standings...),
+			Spectators:   append([]string{}, game.spectators...),
+			Moves:        len(game.moves),
+			StartedAt:    game.startedAt,
+			ActiveAt:     game.activeAt,
+		}
+		for _, player := range game.players {
+			ag.Players = append(ag.Players, srv.adminPlayer(player))
+		}
+		game.mu.Unlock()
+		all = append(all, ag)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ActiveAt.Before(all[j].ActiveAt)
+	})
+	return all, nil
+}
+
+// ForceEndGame ends the game without a winner, its players are released and
+// nothing is archived, rated or counted in stats. It publishes
+// EventGameAborted.
+func (srv *server) ForceEndGame(gameId string, reason string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.execute(&logEntry{Op: opForceEnd, GameId: gameId, Text: reason})
+}
+
+func (srv *server) forceEndGame(gameId string, reason string) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+
+	players := append([]*player(nil), game.players...)
+	if err := game.abort(reason, srv.now); err != nil {
+		return err
+	}
+	if err := srv.saveGame(game, players...); err != nil {
+		return err
+	}
+	log.Printf("game [%s] ended by an operator: %s", game.name, reason)
+	srv.publish(EventGameAborted, game.id, "", reason)
+	return nil
+}
+
+// PauseGame stops the game until ResumeGame, nobody can join, start or
+// play, disconnected players are neither skipped nor forfeited, and the
+// game isn't reaped.
+func (srv *server) PauseGame(gameId string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.execute(&logEntry{Op: opPause, GameId: gameId})
+}
+
+func (srv *server) ResumeGame(gameId string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.execute(&logEntry{Op: opResume, GameId: gameId})
+}
+
+func (srv *server) pauseGame(gameId string, paused bool) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+
+	if err := game.pause(paused, srv.now); err != nil {
+		return err
+	}
+	return srv.saveGame(game)
+}
+
+// KickPlayer makes the player leave the game, in a started game it counts
+// as losing.
+func (srv *server) KickPlayer(gameId string, playerId string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.execute(&logEntry{Op: opKick, GameId: gameId, PlayerId: playerId})
+}
+
+func (srv *server) kickPlayer(gameId string, playerId string) error {
+	err := srv.leaveGame(gameId, playerId)
+	if err != nil && err != ErrLose {
+		return err
+	}
+	if game, err := srv.findGameById(gameId); err == nil {
+		if player, err := srv.findPlayerById(playerId); err == nil {
+			game.systemMessage(srv.now, "%s was kicked by an operator", player.name)
+		}
+		return srv.store.PutGame(game)
+	}
+	return nil
+}
+
+// ResetPlayer clears the player's game, for players stuck in a game that
+// is gone or broken. Unlike KickPlayer it doesn't count as losing, nor as
+// having played the game.
+func (srv *server) ResetPlayer(playerId string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.execute(&logEntry{Op: opResetPlayer, PlayerId: playerId})
+}
+
+func (srv *server) resetPlayer(playerId string) error {
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+
+	if game, err := srv.findGameById(player.gameId); err == nil {
+		game.drop(player)
+		if err := srv.store.PutGame(game); err != nil {
+			return err
+		}
+	}
+	log.Printf("player [%s] reset from game [%s]", player.name, player.gameId)
+	player.gameId = ""
+	player.hand = nil
+	return srv.store.PutPlayer(player)
+}
+
+// Broadcast posts a maintenance notice to the chat of every game not
+// finished yet, and publishes it as EventMaintenance. It returns the number
+// of games notified.
+func (srv *server) Broadcast(text string) (int, error) {
+	text, err := checkChatText(text)
+	if err != nil {
+		return 0, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.logCommand(&logEntry{Op: opBroadcast, Text: text}); err != nil {
+		return 0, err
+	}
+	return srv.broadcast(text)
+}
+
+func (srv *server) broadcast(text string) (int, error) {
+	games, err := srv.store.ListGames()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, game := range games {
+		if game.state == GameFinished {
+			continue
+		}
+		game.systemMessage(srv.now, "maintenance: %s", text)
+		if err := srv.store.PutGame(game); err != nil {
+			return count, err
+		}
+		count++
+	}
+	srv.publish(EventMaintenance, "", "", text)
+	return count, nil
+}
+
+func (game *freeBattleGame) pause(paused bool, at time.Time) error {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if game.state == GameFinished {
+		return ErrInvalidGameState
+	}
+	if !paused && !game.paused {
+		return ErrGameNotPaused
+	}
+	game.touch()
+	game.paused = paused
+	if paused {
+		game.systemMessage(at, "the game was paused by an operator")
+	} else {
+		game.systemMessage(at, "the game was resumed")
+	}
+	return nil
+}
+
+// abort finishes the game on the spot, nobody wins.
+func (game *freeBattleGame) abort(reason string, at time.Time) error {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if game.state == GameFinished {
+		return ErrInvalidGameState
+	}
+	game.touch()
+	for _, player := range game.players {
+		game.deadwood = append(game.deadwood, player.hand...)
+		player.hand = nil
+		player.gameId = ""
+	}
+	game.players = game.players[:0]
+	game.nextPlayerId = ""
+	game.paused = false
+	game.state = GameFinished
+	game.systemMessage(at, "the game was ended by an operator: %s", reason)
+	return nil
+}
+
+// drop takes the player out of the game without any of the rules of leave,
+// the player's hand goes to the deadwood. The player is no longer a
+// participant, the game is counted and rated as if they never played it.
+func (game *freeBattleGame) drop(player *player) {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	for i, id := range game.participants {
+		if id == player.id {
+			game.participants = append(game.participants[:i], game.participants[i+1:]...)
+			delete(game.tallies, player.id)
+			break
+		}
+	}
+	for i, p := range game.players {
+		if p.id != player.id {
+			continue
+		}
+		game.touch()
+		if game.nextPlayerId == player.id && len(game.players) > 1 {
+			game.passTurn(player)
+		}
+		game.deadwood = append(game.deadwood, player.hand...)
+		game.players = append(game.players[:i], game.players[i+1:]...)
+		if len(game.players) == 0 {
+			game.nextPlayerId = ""
+		}
+		return
+	}
+}
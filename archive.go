@@ -0,0 +1,252 @@
+package dl99
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	EffectAdd        = "add"
+	EffectSubtract   = "subtract"
+	EffectDeadline   = "deadline"
+	EffectNextPlayer = "next_player"
+	EffectReverse    = "reverse"
+	EffectSteal      = "steal"
+	EffectSwap       = "swap"
+)
+
+const (
+	DefaultMaxArchives   = 10000
+	DefaultMaxArchiveAge = 30 * 24 * time.Hour
+	// the weekly leaderboard counts the archives of the last week
+	MinArchiveAge = 7 * 24 * time.Hour
+
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// Move is one card played in a game.
+type Move struct {
+	Seq      int    `json:"seq"`
+	PlayerId string `json:"player_id"`
+	Card     string `json:"card"`
+	Effect   string `json:"effect"`
+	// the player picked by A, J or 7, empty if the pick was not in the game
+	Target string `json:"target,omitempty"`
+	// the score after the move, beyond the deadline if Busted
+	Score  int       `json:"score"`
+	Busted bool      `json:"busted"`
+	At     time.Time `json:"at"`
+}
+
+// GameArchive is what remains of a game once it finished, it outlives the
+// game itself.
+type GameArchive struct {
+	Id              string    `json:"id"`
+	Name            string    `json:"name"`
+	Score           int       `json:"score"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+
+	// whether the game changed ratings, see freeBattleGame.rated
+	Rated        bool             `json:"rated"`
+	Participants []ArchivedPlayer `json:"participants"`
+
+	// player ids, the winner first
+	Standings []string `json:"standings"`
+
+	// left out when listing archives, see History
+	Moves []Move `json:"moves,omitempty"`
+}
+
+// HistoryQuery searches archived games, newest first. Zero values don't
+// filter.
+type HistoryQuery struct {
+	PlayerId string    `form:"player_id"`
+	Since    time.Time `form:"since" time_format:"2006-01-02"`
+	Until    time.Time `form:"until" time_format:"2006-01-02"`
+	Offset   int       `form:"offset"`
+	Limit    int       `form:"limit"`
+}
+
+type History struct {
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	Games  []GameArchive `json:"games"`
+}
+
+// archiveRetention bounds the archive, the oldest archives go first.
+type archiveRetention struct {
+	maxArchives int
+	maxAge      time.Duration
+}
+
+type ArchivedPlayer struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Bot       bool   `json:"bot"`
+	Placement int    `json:"placement"`
+
+	// rating after this game, and how much this game changed it
+	Rating      float64 `json:"rating"`
+	RatingDelta float64 `json:"rating_delta"`
+}
+
+func newGameArchive(game *freeBattleGame, participants []*player, rated bool, finishedAt time.Time) *GameArchive {
+	archive := &GameArchive{
+		Id:              game.id,
+		Name:            game.name,
+		Score:           game.score,
+		StartedAt:       game.startedAt,
+		FinishedAt:      finishedAt,
+		DurationSeconds: finishedAt.Sub(game.startedAt).Seconds(),
+		Rated:           rated,
+		Participants:    make([]ArchivedPlayer, 0, len(participants)),
+		Standings:       make([]string, 0, len(game.standings)),
+		Moves:           append([]Move(nil), game.moves...),
+	}
+	for i := len(game.standings) - 1; i >= 0; i-- {
+		archive.Standings = append(archive.Standings, game.standings[i])
+	}
+	for _, player := range participants {
+		archived := ArchivedPlayer{
+			Id:        player.id,
+			Name:      player.name,
+			Bot:       player.bot,
+			Placement: game.placement(player.id),
+			Rating:    player.rating,
+		}
+		if rated && len(player.ratingHistory) > 0 {
+			archived.RatingDelta = player.ratingHistory[len(player.ratingHistory)-1].Delta
+		}
+		archive.Participants = append(archive.Participants, archived)
+	}
+	return archive
+}
+
+func (archive *GameArchive) involves(playerId string) bool {
+	for _, p := range archive.Participants {
+		if p.Id == playerId {
+			return true
+		}
+	}
+	return false
+}
+
+func (query *HistoryQuery) normalize() {
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultHistoryLimit
+	}
+	if query.Limit > maxHistoryLimit {
+		query.Limit = maxHistoryLimit
+	}
+}
+
+// History searches the archived games, newest first. The listed archives
+// leave out the moves, get them with GameArchive.
+func (srv *server) History(query HistoryQuery) (History, error) {
+	query.normalize()
+
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	archives, err := srv.store.ListArchives()
+	if err != nil {
+		return History{}, err
+	}
+
+	matched := make([]*GameArchive, 0, len(archives))
+	for _, archive := range archives {
+		if query.PlayerId != "" && !archive.involves(query.PlayerId) {
+			continue
+		}
+		if !query.Since.IsZero() && archive.FinishedAt.Before(query.Since) {
+			continue
+		}
+		// until is a day, the whole day counts
+		if !query.Until.IsZero() && !archive.FinishedAt.Before(query.Until.AddDate(0, 0, 1)) {
+			continue
+		}
+		matched = append(matched, archive)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].FinishedAt.After(matched[j].FinishedAt)
+	})
+
+	history := History{
+		Total:  len(matched),
+		Offset: query.Offset,
+		Limit:  query.Limit,
+		Games:  make([]GameArchive, 0, query.Limit),
+	}
+	for i := query.Offset; i < len(matched) && i < query.Offset+query.Limit; i++ {
+		summary := *matched[i]
+		summary.Moves = nil
+		history.Games = append(history.Games, summary)
+	}
+	return history, nil
+}
+
+func (srv *server) GameArchive(gameId string) (GameArchive, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	archive, err := srv.store.GetArchive(gameId)
+	if err != nil {
+		return GameArchive{}, err
+	}
+	return *archive, nil
+}
+
+// SetArchiveRetention keeps at most maxArchives archived games, none older
+// than maxAge. Zero or less keeps the default, maxAge is at least
+// MinArchiveAge. Pruning drops whole archives, the players' stats and
+// ratings stay.
+func (srv *server) SetArchiveRetention(maxArchives int, maxAge time.Duration) {
+	if maxArchives <= 0 {
+		maxArchives = DefaultMaxArchives
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultMaxArchiveAge
+	}
+	if maxAge < MinArchiveAge {
+		maxAge = MinArchiveAge
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.retention = archiveRetention{maxArchives: maxArchives, maxAge: maxAge}
+}
+
+// pruneArchives drops archives beyond the retention limits, returning how
+// many were dropped.
+func (srv *server) pruneArchives() int {
+	archives, err := srv.store.ListArchives()
+	if err != nil {
+		log.Printf("list archives failed: %v", err)
+		return 0
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].FinishedAt.After(archives[j].FinishedAt)
+	})
+
+	pruned := 0
+	for i, archive := range archives {
+		if i < srv.retention.maxArchives && srv.now.Sub(archive.FinishedAt) <= srv.retention.maxAge {
+			continue
+		}
+		if err := srv.store.DeleteArchive(archive.Id); err != nil {
+			log.Printf("delete archive [%s] failed: %v", archive.Id, err)
+			continue
+		}
+		pruned++
+	}
+	return pruned
+}
@@ -0,0 +1,205 @@
+package dl99
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	playersBucket  = []byte("players")
+	gamesBucket    = []byte("games")
+	archivesBucket = []byte("archives")
+	accountsBucket = []byte("accounts")
+)
+
+// boltStore keeps everything in a single bolt key/value file. Reads are
+// served from an in-memory copy loaded when the file is opened, every Put and
+// Delete is written through to the file before it returns.
+type boltStore struct {
+	db    *bolt.DB
+	cache *memoryStore
+}
+
+// OpenBoltStore opens or creates the store file at path.
+func OpenBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	store := &boltStore{
+		db:    db,
+		cache: NewMemoryStore().(*memoryStore),
+	}
+	if err := store.load(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *boltStore) load() error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{playersBucket, gamesBucket, archivesBucket, accountsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// players first, games link to them
+		err := tx.Bucket(playersBucket).ForEach(func(k, v []byte) error {
+			var record playerRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			return store.cache.PutPlayer(record.restore())
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(gamesBucket).ForEach(func(k, v []byte) error {
+			var record gameRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			game, err := record.restore(store.cache.GetPlayer)
+			if err != nil {
+				return err
+			}
+			return store.cache.PutGame(game)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(archivesBucket).ForEach(func(k, v []byte) error {
+			var archive GameArchive
+			if err := json.Unmarshal(v, &archive); err != nil {
+				return err
+			}
+			return store.cache.PutArchive(&archive)
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+			var record accountRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			return store.cache.PutAccount(record.restore())
+		})
+	})
+}
+
+func (store *boltStore) put(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (store *boltStore) delete(bucket []byte, key string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+func (store *boltStore) GetPlayer(id string) (*player, error) {
+	return store.cache.GetPlayer(id)
+}
+
+func (store *boltStore) PutPlayer(player *player) error {
+	if err := store.put(playersBucket, player.id, player.record()); err != nil {
+		return err
+	}
+	return store.cache.PutPlayer(player)
+}
+
+func (store *boltStore) ListPlayers() ([]*player, error) {
+	return store.cache.ListPlayers()
+}
+
+func (store *boltStore) DeletePlayer(id string) error {
+	if err := store.delete(playersBucket, id); err != nil {
+		return err
+	}
+	return store.cache.DeletePlayer(id)
+}
+
+func (store *boltStore) GetGame(id string) (*freeBattleGame, error) {
+	return store.cache.GetGame(id)
+}
+
+func (store *boltStore) PutGame(game *freeBattleGame) error {
+	if err := store.put(gamesBucket, game.id, game.record()); err != nil {
+		return err
+	}
+	return store.cache.PutGame(game)
+}
+
+func (store *boltStore) ListGames() ([]*freeBattleGame, error) {
+	return store.cache.ListGames()
+}
+
+func (store *boltStore) DeleteGame(id string) error {
+	if err := store.delete(gamesBucket, id); err != nil {
+		return err
+	}
+	return store.cache.DeleteGame(id)
+}
+
+func (store *boltStore) GetArchive(id string) (*GameArchive, error) {
+	return store.cache.GetArchive(id)
+}
+
+func (store *boltStore) PutArchive(archive *GameArchive) error {
+	if err := store.put(archivesBucket, archive.Id, archive); err != nil {
+		return err
+	}
+	return store.cache.PutArchive(archive)
+}
+
+func (store *boltStore) ListArchives() ([]*GameArchive, error) {
+	return store.cache.ListArchives()
+}
+
+func (store *boltStore) DeleteArchive(id string) error {
+	if err := store.delete(archivesBucket, id); err != nil {
+		return err
+	}
+	return store.cache.DeleteArchive(id)
+}
+
+func (store *boltStore) GetAccount(username string) (*account, error) {
+	return store.cache.GetAccount(username)
+}
+
+func (store *boltStore) PutAccount(account *account) error {
+	if err := store.put(accountsBucket, account.username, account.record()); err != nil {
+		return err
+	}
+	return store.cache.PutAccount(account)
+}
+
+func (store *boltStore) ListAccounts() ([]*account, error) {
+	return store.cache.ListAccounts()
+}
+
+func (store *boltStore) DeleteAccount(username string) error {
+	if err := store.delete(accountsBucket, username); err != nil {
+		return err
+	}
+	return store.cache.DeleteAccount(username)
+}
+
+func (store *boltStore) Close() error {
+	return store.db.Close()
+}
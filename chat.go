@@ -0,0 +1,334 @@
+package dl99
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrEmptyChatMessage   = errors.New("empty chat message")
+	ErrChatMessageTooLong = errors.New("chat message too long")
+	ErrChatRateLimited    = errors.New("sending chat messages too fast")
+	ErrNotGameMember      = errors.New("neither playing nor spectating this game")
+	ErrAlreadySpectating  = errors.New("already spectating this game")
+	ErrNotSpectating      = errors.New("not spectating this game")
+)
+
+const (
+	maxChatMessageLength = 280
+	// messages kept per game, older ones are dropped
+	maxChatHistory = 200
+	// messages sent before a member joined that the member can still read
+	chatHistoryOnJoin = 50
+
+	chatRateLimit       = 5
+	chatRateLimitWindow = 10 * time.Second
+)
+
+type ChatMessage struct {
+	Seq uint64 `json:"seq"`
+	// empty for system messages
+	PlayerId string    `json:"player_id,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Text     string    `json:"text"`
+	System   bool      `json:"system"`
+	At       time.Time `json:"at"`
+}
+
+// chatLog is a game's chat, readable by players, participants who are out
+// already and spectators.
+type chatLog struct {
+	Messages []ChatMessage `json:"messages"`
+	LastSeq  uint64        `json:"last_seq"`
+
+	// member id -> first seq the member can read
+	Readable map[string]uint64 `json:"readable"`
+
+	// member id -> times of recent messages, for rate limiting
+	sent map[string][]time.Time
+}
+
+func newChatLog() *chatLog {
+	return &chatLog{
+		Messages: make([]ChatMessage, 0),
+		Readable: make(map[string]uint64),
+		sent:     make(map[string][]time.Time),
+	}
+}
+
+func (chat *chatLog) append(message ChatMessage) {
+	chat.LastSeq++
+	message.Seq = chat.LastSeq
+	chat.Messages = append(chat.Messages, message)
+	if len(chat.Messages) > maxChatHistory {
+		chat.Messages = chat.Messages[len(chat.Messages)-maxChatHistory:]
+	}
+}
+
+// admit lets a new member read the recent history, calling it again for the
+// same member keeps what the member could read before.
+func (chat *chatLog) admit(memberId string) {
+	if _, ok := chat.Readable[memberId]; ok {
+		return
+	}
+	first := uint64(1)
+	if chat.LastSeq > chatHistoryOnJoin {
+		first = chat.LastSeq - chatHistoryOnJoin + 1
+	}
+	chat.Readable[memberId] = first
+}
+
+// since returns the messages after seq the member is allowed to read.
+func (chat *chatLog) since(memberId string, seq uint64) []ChatMessage {
+	if first := chat.Readable[memberId]; first > 0 && seq < first-1 {
+		seq = first - 1
+	}
+	messages := make([]ChatMessage, 0)
+	for _, message := range chat.Messages {
+		if message.Seq > seq {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// allow tells whether the member may send another message now, and if so
+// counts it.
+func (chat *chatLog) allow(memberId string, now time.Time) bool {
+	if chat.sent == nil {
+		chat.sent = make(map[string][]time.Time)
+	}
+	recent := chat.sent[memberId][:0]
+	for _, at := range chat.sent[memberId] {
+		if now.Sub(at) < chatRateLimitWindow {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= chatRateLimit {
+		chat.sent[memberId] = recent
+		return false
+	}
+	chat.sent[memberId] = append(recent, now)
+	return true
+}
+
+func checkChatText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", ErrEmptyChatMessage
+	}
+	if utf8.RuneCountInString(text) > maxChatMessageLength {
+		return "", ErrChatMessageTooLong
+	}
+	return text, nil
+}
+
+func (game *freeBattleGame) chatLog() *chatLog {
+	if game.chat == nil {
+		game.chat = newChatLog()
+	}
+	return game.chat
+}
+
+// systemMessage posts in the name of the server, at is the time of the
+// command that caused it, so a replay posts the same message.
+func (game *freeBattleGame) systemMessage(at time.Time, format string, args ...interface{}) {
+	game.chatLog().append(ChatMessage{
+		Text:   fmt.Sprintf(format, args...),
+		System: true,
+		At:     at,
+	})
+}
+
+// member tells whether the player may use this game's chat: players,
+// participants who are out already, and spectators.
+func (game *freeBattleGame) member(playerId string) bool {
+	for _, player := range game.players {
+		if player.id == playerId {
+			return true
+		}
+	}
+	for _, id := range game.participants {
+		if id == playerId {
+			return true
+		}
+	}
+	for _, id := range game.spectators {
+		if id == playerId {
+			return true
+		}
+	}
+	return false
+}
+
+func (game *freeBattleGame) spectate(player *player, at time.Time) error {
+	for _, p := range game.players {
+		if p.id == player.id {
+			return ErrPlayerAlreadyJoined
+		}
+	}
+	for _, id := range game.spectators {
+		if id == player.id {
+			return ErrAlreadySpectating
+		}
+	}
+	game.spectators = append(game.spectators, player.id)
+	game.touch()
+	game.chatLog().admit(player.id)
+	game.systemMessage(at, "%s is watching", player.name)
+	return nil
+}
+
+func (game *freeBattleGame) unspectate(player *player, at time.Time) error {
+	for i, id := range game.spectators {
+		if id == player.id {
+			game.spectators = append(game.spectators[:i], game.spectators[i+1:]...)
+			game.touch()
+			game.systemMessage(at, "%s stopped watching", player.name)
+			return nil
+		}
+	}
+	return ErrNotSpectating
+}
+
+// Spectate lets the player watch the game and use its chat. Like JoinGame,
+// a private game needs an invitation, its invite code or its password.
+func (srv *server) Spectate(gameId string, playerId string, inviteCode string, password string, ifVersion *uint64) error {
+	if err := srv.checkJoin(gameId, playerId, inviteCode, password); err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opSpectate, GameId: gameId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.spectate(gameId, playerId)
+}
+
+func (srv *server) spectate(gameId string, playerId string) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+
+	if err := game.spectate(player, srv.now); err != nil {
+		return err
+	}
+	srv.publish(EventSpectatorJoined, game.id, player.id, nil)
+	return srv.store.PutGame(game)
+}
+
+func (srv *server) Unspectate(gameId string, playerId string, ifVersion *uint64) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opUnspectate, GameId: gameId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.unspectate(gameId, playerId)
+}
+
+func (srv *server) unspectate(gameId string, playerId string) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+
+	if err := game.unspectate(player, srv.now); err != nil {
+		return err
+	}
+	srv.publish(EventSpectatorLeft, game.id, player.id, nil)
+	return srv.store.PutGame(game)
+}
+
+// PostChat sends a message to the game's chat as the player, who has to be
+// a member of the game, see freeBattleGame.member.
+func (srv *server) PostChat(gameId string, playerId string, text string) error {
+	text, err := checkChatText(text)
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+	if !game.member(playerId) {
+		return ErrNotGameMember
+	}
+	// rate limited here and not in postChat, replaying the log runs much
+	// faster than the players typed
+	if !game.chatLog().allow(playerId, time.Now()) {
+		return ErrChatRateLimited
+	}
+
+	if err := srv.logCommand(&logEntry{Op: opChat, GameId: gameId, PlayerId: playerId, Text: text}); err != nil {
+		return err
+	}
+	return srv.postChat(gameId, playerId, text)
+}
+
+func (srv *server) postChat(gameId string, playerId string, text string) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+
+	if !game.member(playerId) {
+		return ErrNotGameMember
+	}
+	chat := game.chatLog()
+	chat.append(ChatMessage{
+		PlayerId: player.id,
+		Name:     player.name,
+		Text:     text,
+		At:       srv.now,
+	})
+	srv.publish(EventChatMessage, game.id, player.id, chat.Messages[len(chat.Messages)-1])
+	return srv.store.PutGame(game)
+}
+
+// ChatMessages returns the game's chat messages after seq that the player,
+// a member of the game, is allowed to read.
+func (srv *server) ChatMessages(gameId string, playerId string, seq uint64) ([]ChatMessage, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return nil, err
+	}
+	if !game.member(playerId) {
+		return nil, ErrNotGameMember
+	}
+	return game.chatLog().since(playerId, seq), nil
+}
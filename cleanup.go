@@ -0,0 +1,175 @@
+package dl99
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	ReapedUnstarted = "unstarted"
+	ReapedInactive  = "inactive"
+	ReapedFinished  = "finished"
+)
+
+// CleanupPolicy is how long games may stay around in each state, counted
+// from the last time a player did something in the game. Zero or less
+// reaps them on the next clean up.
+type CleanupPolicy struct {
+	// created but never started, lobbies nobody starts
+	CreatedTTL time.Duration
+	// started but nobody played, everyone disconnected
+	InactiveTTL time.Duration
+	// finished games are archived already, see gameFinished
+	FinishedTTL time.Duration
+}
+
+var DefaultCleanupPolicy = CleanupPolicy{
+	CreatedTTL:  30 * time.Minute,
+	InactiveTTL: 10 * time.Minute,
+	FinishedTTL: 0,
+}
+
+// ReapedGame is a game removed by a clean up and why.
+type ReapedGame struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	State  int    `json:"state"`
+	Reason string `json:"reason"`
+	// players released from the game, they can join another one
+	Released []string `json:"released"`
+}
+
+type CleanupReport struct {
+	At             time.Time    `json:"at"`
+	Games          []ReapedGame `json:"games"`
+	ArchivesPruned int          `json:"archives_pruned"`
+}
+
+func (srv *server) SetCleanupPolicy(policy CleanupPolicy) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.cleanup = policy
+}
+
+// OnGameReaped registers a hook called for every game a clean up removes,
+// after its players were released. Hooks run with the server locked and
+// must not call back into it.
+func (srv *server) OnGameReaped(hook func(ReapedGame)) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.reapHooks = append(srv.reapHooks, hook)
+}
+
+// reapReason tells why the game should be reaped now, empty if it stays.
+func (policy CleanupPolicy) reapReason(game *freeBattleGame, now time.Time) string {
+	// an operator is looking into it, resuming starts the clock again
+	if game.paused {
+		return ""
+	}
+	idle := now.Sub(game.activeAt)
+	switch game.state {
+	case GameCreated:
+		if idle >= policy.CreatedTTL {
+			return ReapedUnstarted
+		}
+	case GameStarted:
+		if idle >= policy.InactiveTTL {
+			return ReapedInactive
+		}
+	case GameFinished:
+		if idle >= policy.FinishedTTL {
+			return ReapedFinished
+		}
+	}
+	return ""
+}
+
+// CleanUpGames removes the games the cleanup policy says are stale, and
+// prunes the archive, see SetArchiveRetention.
+func (srv *server) CleanUpGames() CleanupReport {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.logCommand(&logEntry{Op: opCleanUp}); err != nil {
+		log.Printf("clean up games failed: %v", err)
+		return CleanupReport{Games: []ReapedGame{}}
+	}
+	return srv.cleanUpGames()
+}
+
+func (srv *server) cleanUpGames() CleanupReport {
+	report := CleanupReport{At: srv.now, Games: make([]ReapedGame, 0)}
+
+	games, err := srv.store.ListGames()
+	if err != nil {
+		log.Printf("list games failed: %v", err)
+		return report
+	}
+
+	for _, game := range games {
+		// restored from a snapshot older than activeAt, start the clock now
+		if game.activeAt.IsZero() {
+			game.activeAt = srv.now
+			if err := srv.store.PutGame(game); err != nil {
+				log.Printf("put game [%s] failed: %v", game.name, err)
+			}
+			continue
+		}
+		reason := srv.cleanup.reapReason(game, srv.now)
+		if reason == "" {
+			continue
+		}
+
+		reaped := ReapedGame{
+			Id:       game.id,
+			Name:     game.name,
+			State:    game.state,
+			Reason:   reason,
+			Released: srv.releasePlayers(game),
+		}
+		if err := srv.store.DeleteGame(game.id); err != nil {
+			log.Printf("delete game [%s] failed: %v", game.name, err)
+			continue
+		}
+		// waiters find the game gone
+		game.touch()
+		srv.publish(EventGameReaped, game.id, "", reaped)
+		for _, hook := range srv.reapHooks {
+			hook(reaped)
+		}
+		log.Printf("game [%s] reaped: %s", game.name, reason)
+		report.Games = append(report.Games, reaped)
+	}
+
+	report.ArchivesPruned = srv.pruneArchives()
+	return report
+}
+
+// releasePlayers takes the players still in the game out of it, returning
+// their ids.
+func (srv *server) releasePlayers(game *freeBattleGame) []string {
+	released := make([]string, 0, len(game.players))
+	for _, player := range game.players {
+		if player.gameId != game.id {
+			continue
+		}
+		player.gameId = ""
+		player.hand = nil
+		if err := srv.store.PutPlayer(player); err != nil {
+			log.Printf("release player [%s] failed: %v", player.name, err)
+			continue
+		}
+		released = append(released, player.id)
+	}
+	game.players = game.players[:0]
+
+	// matched into the game, the players may queue again
+	for playerId, ticket := range srv.tickets {
+		if ticket.gameId == game.id {
+			delete(srv.tickets, playerId)
+		}
+	}
+	return released
+}
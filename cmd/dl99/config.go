@@ -0,0 +1,305 @@
+package main
+
+import (
+	"dl99"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix prefixes the environment overrides, e.g. DL99_SERVER_PORT for
+// server.port.
+const envPrefix = "DL99"
+
+// config is everything cmd/dl99 can be configured with. Later sources win:
+// defaults, the -config file, DL99_* environment variables, then flags.
+type config struct {
+	Server      serverConfig      `yaml:"server"`
+	Limits      limitsConfig      `yaml:"limits"`
+	Store       storeConfig       `yaml:"store"`
+	Cleanup     cleanupConfig     `yaml:"cleanup"`
+	Matchmaking matchmakingConfig `yaml:"matchmaking"`
+	Presence    presenceConfig    `yaml:"presence"`
+	Auth        authConfig        `yaml:"auth"`
+}
+
+type serverConfig struct {
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	DrainTimeout    time.Duration `yaml:"drain_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// trust X-Forwarded-For and X-Real-Ip for the client address, only
+	// behind a proxy setting them, anyone could send them otherwise
+	BehindProxy bool `yaml:"behind_proxy"`
+}
+
+type limitsConfig struct {
+	MaxPlayers  int     `yaml:"max_players"`
+	MaxGames    int     `yaml:"max_games"`
+	CreateRate  float64 `yaml:"create_rate"`
+	CreateBurst int     `yaml:"create_burst"`
+	PlayRate    float64 `yaml:"play_rate"`
+	PlayBurst   int     `yaml:"play_burst"`
+}
+
+type storeConfig struct {
+	Kind             string        `yaml:"kind"`
+	Path             string        `yaml:"path"`
+	DataDir          string        `yaml:"data_dir"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+type cleanupConfig struct {
+	Interval      time.Duration `yaml:"interval"`
+	CreatedTTL    time.Duration `yaml:"created_ttl"`
+	InactiveTTL   time.Duration `yaml:"inactive_ttl"`
+	FinishedTTL   time.Duration `yaml:"finished_ttl"`
+	ArchiveMax    int           `yaml:"archive_max"`
+	ArchiveMaxAge time.Duration `yaml:"archive_max_age"`
+}
+
+type matchmakingConfig struct {
+	Interval         time.Duration `yaml:"interval"`
+	RatingBand       float64       `yaml:"rating_band"`
+	BandWiden        float64       `yaml:"band_widen"`
+	DefaultRuleSet   string        `yaml:"default_rule_set"`
+	DefaultTableSize int           `yaml:"default_table_size"`
+}
+
+type presenceConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Grace    time.Duration `yaml:"grace"`
+	Turns    string        `yaml:"turns"`
+	Forfeit  time.Duration `yaml:"forfeit"`
+}
+
+type authConfig struct {
+	AdminToken string        `yaml:"admin_token"`
+	SessionTTL time.Duration `yaml:"session_ttl"`
+}
+
+func defaultConfig() config {
+	var cfg config
+	cfg.Server.Host = "0.0.0.0"
+	cfg.Server.Port = 9999
+	cfg.Server.ShutdownTimeout = 10 * time.Second
+
+	cfg.Limits.MaxPlayers = dl99.DefaultMaxPlayers
+	cfg.Limits.MaxGames = dl99.DefaultMaxGames
+	cfg.Limits.CreateRate = 10
+	cfg.Limits.CreateBurst = 5
+	cfg.Limits.PlayRate = 120
+	cfg.Limits.PlayBurst = 20
+
+	cfg.Store.Kind = "memory"
+	cfg.Store.Path = "dl99.db"
+	cfg.Store.SnapshotInterval = 5 * time.Minute
+
+	cfg.Cleanup.Interval = time.Minute
+	cfg.Cleanup.CreatedTTL = dl99.DefaultCleanupPolicy.CreatedTTL
+	cfg.Cleanup.InactiveTTL = dl99.DefaultCleanupPolicy.InactiveTTL
+	cfg.Cleanup.FinishedTTL = dl99.DefaultCleanupPolicy.FinishedTTL
+	cfg.Cleanup.ArchiveMax = dl99.DefaultMaxArchives
+	cfg.Cleanup.ArchiveMaxAge = dl99.DefaultMaxArchiveAge
+
+	cfg.Matchmaking.Interval = 2 * time.Second
+	cfg.Matchmaking.BandWiden = 50
+	cfg.Matchmaking.DefaultRuleSet = dl99.RuleSetFreeBattle
+	cfg.Matchmaking.DefaultTableSize = 4
+
+	cfg.Presence.Interval = 5 * time.Second
+	cfg.Presence.Grace = dl99.DefaultPresencePolicy.GracePeriod
+	cfg.Presence.Turns = dl99.DefaultPresencePolicy.Turns
+	cfg.Presence.Forfeit = dl99.DefaultPresencePolicy.ForfeitAfter
+
+	cfg.Auth.SessionTTL = dl99.DefaultSessionTTL
+	return cfg
+}
+
+// bindFlags points the flags at cfg, parsing them again after loading the
+// file and the environment makes the flags given on the command line win.
+func (cfg *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Server.Host, "host", cfg.Server.Host, "the server host")
+	fs.IntVar(&cfg.Server.Port, "port", cfg.Server.Port, "the server port")
+	fs.DurationVar(&cfg.Server.DrainTimeout, "drain-timeout", cfg.Server.DrainTimeout, "on shutdown, how long to wait for running games to finish, 0 doesn't wait")
+	fs.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "on shutdown, how long to wait for in-flight requests")
+	fs.BoolVar(&cfg.Server.BehindProxy, "behind-proxy", cfg.Server.BehindProxy, "take the client address from X-Forwarded-For or X-Real-Ip, set only behind a proxy setting them")
+
+	fs.IntVar(&cfg.Limits.MaxPlayers, "max-players", cfg.Limits.MaxPlayers, "max players")
+	fs.IntVar(&cfg.Limits.MaxGames, "max-games", cfg.Limits.MaxGames, "max game")
+	fs.Float64Var(&cfg.Limits.CreateRate, "create-rate", cfg.Limits.CreateRate, "players, accounts and games created per minute, per address and per player")
+	fs.IntVar(&cfg.Limits.CreateBurst, "create-burst", cfg.Limits.CreateBurst, "creations allowed at once")
+	fs.Float64Var(&cfg.Limits.PlayRate, "play-rate", cfg.Limits.PlayRate, "gameplay requests per minute, per address and per player")
+	fs.IntVar(&cfg.Limits.PlayBurst, "play-burst", cfg.Limits.PlayBurst, "gameplay requests allowed at once")
+
+	fs.StringVar(&cfg.Store.Kind, "store", cfg.Store.Kind, "where players and games are kept: memory or bolt")
+	fs.StringVar(&cfg.Store.Path, "store-path", cfg.Store.Path, "the bolt store file, used when -store is bolt")
+	fs.StringVar(&cfg.Store.DataDir, "data-dir", cfg.Store.DataDir, "directory of snapshot and command log, empty disables persistence")
+	fs.DurationVar(&cfg.Store.SnapshotInterval, "snapshot-interval", cfg.Store.SnapshotInterval, "how often to snapshot the server state")
+
+	fs.DurationVar(&cfg.Cleanup.Interval, "cleanup-interval", cfg.Cleanup.Interval, "how often to clean up stale games")
+	fs.DurationVar(&cfg.Cleanup.CreatedTTL, "created-ttl", cfg.Cleanup.CreatedTTL, "how long a game may wait to be started")
+	fs.DurationVar(&cfg.Cleanup.InactiveTTL, "inactive-ttl", cfg.Cleanup.InactiveTTL, "how long a started game may go without a move")
+	fs.DurationVar(&cfg.Cleanup.FinishedTTL, "finished-ttl", cfg.Cleanup.FinishedTTL, "how long a finished game is kept besides its archive")
+	fs.IntVar(&cfg.Cleanup.ArchiveMax, "archive-max", cfg.Cleanup.ArchiveMax, "max archived games kept")
+	fs.DurationVar(&cfg.Cleanup.ArchiveMaxAge, "archive-max-age", cfg.Cleanup.ArchiveMaxAge, "how long archived games are kept")
+
+	fs.DurationVar(&cfg.Matchmaking.Interval, "match-interval", cfg.Matchmaking.Interval, "how often to form games from the matchmaking queue")
+	fs.Float64Var(&cfg.Matchmaking.RatingBand, "match-rating-band", cfg.Matchmaking.RatingBand, "max rating difference of matched players, 0 ignores ratings")
+	fs.Float64Var(&cfg.Matchmaking.BandWiden, "match-band-widen", cfg.Matchmaking.BandWiden, "rating band widening per minute of waiting")
+	fs.StringVar(&cfg.Matchmaking.DefaultRuleSet, "match-rule-set", cfg.Matchmaking.DefaultRuleSet, "rule set of players queueing without one")
+	fs.IntVar(&cfg.Matchmaking.DefaultTableSize, "match-table-size", cfg.Matchmaking.DefaultTableSize, "table size of players queueing without one")
+
+	fs.DurationVar(&cfg.Presence.Interval, "presence-interval", cfg.Presence.Interval, "how often to check for disconnected players")
+	fs.DurationVar(&cfg.Presence.Grace, "presence-grace", cfg.Presence.Grace, "silence after which a player is disconnected")
+	fs.StringVar(&cfg.Presence.Turns, "presence-turns", cfg.Presence.Turns, "what happens to a disconnected player's turn: pause or skip")
+	fs.DurationVar(&cfg.Presence.Forfeit, "presence-forfeit", cfg.Presence.Forfeit, "silence after which a player leaves their game, 0 never")
+
+	fs.StringVar(&cfg.Auth.AdminToken, "admin-token", cfg.Auth.AdminToken, "token of the /admin API, empty disables it")
+	fs.DurationVar(&cfg.Auth.SessionTTL, "session-ttl", cfg.Auth.SessionTTL, "how long a login lasts")
+}
+
+// loadFile reads a YAML config file, unknown keys are errors so typos don't
+// go unnoticed.
+func (cfg *config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides cfg with the DL99_<SECTION>_<KEY> environment variables,
+// named after the YAML keys, e.g. DL99_LIMITS_MAX_GAMES.
+func (cfg *config) loadEnv() error {
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := yamlName(sections.Type().Field(i))
+		for j := 0; j < section.NumField(); j++ {
+			name := strings.ToUpper(envPrefix + "_" + sectionName + "_" + yamlName(section.Type().Field(j)))
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setField(section.Field(j), value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func yamlName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// validate reports every problem at once.
+func (cfg *config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.Server.Port > 0 && cfg.Server.Port < 65536, "server.port must be 1-65535, got %d", cfg.Server.Port)
+	check(cfg.Server.DrainTimeout >= 0, "server.drain_timeout must not be negative")
+	check(cfg.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check(cfg.Limits.MaxPlayers > 0, "limits.max_players must be positive")
+	check(cfg.Limits.MaxGames > 0, "limits.max_games must be positive")
+	check(cfg.Limits.CreateRate > 0, "limits.create_rate must be positive")
+	check(cfg.Limits.CreateBurst > 0, "limits.create_burst must be positive")
+	check(cfg.Limits.PlayRate > 0, "limits.play_rate must be positive")
+	check(cfg.Limits.PlayBurst > 0, "limits.play_burst must be positive")
+
+	check(cfg.Store.Kind == "memory" || cfg.Store.Kind == "bolt", "store.kind must be memory or bolt, got %q", cfg.Store.Kind)
+	check(cfg.Store.Kind != "bolt" || cfg.Store.Path != "", "store.path is required by the bolt store")
+	check(cfg.Store.SnapshotInterval > 0, "store.snapshot_interval must be positive")
+
+	check(cfg.Cleanup.Interval > 0, "cleanup.interval must be positive")
+	check(cfg.Cleanup.CreatedTTL >= 0, "cleanup.created_ttl must not be negative")
+	check(cfg.Cleanup.InactiveTTL >= 0, "cleanup.inactive_ttl must not be negative")
+	check(cfg.Cleanup.FinishedTTL >= 0, "cleanup.finished_ttl must not be negative")
+	check(cfg.Cleanup.ArchiveMax > 0, "cleanup.archive_max must be positive")
+	check(cfg.Cleanup.ArchiveMaxAge >= dl99.MinArchiveAge, "cleanup.archive_max_age must be at least %s, the weekly leaderboard reads the archives", dl99.MinArchiveAge)
+
+	check(cfg.Matchmaking.Interval > 0, "matchmaking.interval must be positive")
+	check(cfg.Matchmaking.RatingBand >= 0, "matchmaking.rating_band must not be negative")
+	check(cfg.Matchmaking.BandWiden >= 0, "matchmaking.band_widen must not be negative")
+	check(cfg.Matchmaking.DefaultRuleSet == dl99.RuleSetFreeBattle, "matchmaking.default_rule_set must be %s, got %q", dl99.RuleSetFreeBattle, cfg.Matchmaking.DefaultRuleSet)
+	check(cfg.Matchmaking.DefaultTableSize >= 2 && cfg.Matchmaking.DefaultTableSize <= 8, "matchmaking.default_table_size must be 2-8, got %d", cfg.Matchmaking.DefaultTableSize)
+
+	check(cfg.Presence.Interval > 0, "presence.interval must be positive")
+	check(cfg.Presence.Grace > 0, "presence.grace must be positive")
+	check(cfg.Presence.Turns == dl99.TurnPause || cfg.Presence.Turns == dl99.TurnSkip, "presence.turns must be pause or skip, got %q", cfg.Presence.Turns)
+	check(cfg.Presence.Forfeit == 0 || cfg.Presence.Forfeit >= cfg.Presence.Grace, "presence.forfeit must be 0 or at least presence.grace")
+
+	check(cfg.Auth.AdminToken == "" || len(cfg.Auth.AdminToken) >= 16, "auth.admin_token must be at least 16 characters")
+	check(cfg.Auth.SessionTTL > 0, "auth.session_ttl must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// print writes the effective config as YAML, hiding the admin token.
+func (cfg config) print() error {
+	if cfg.Auth.AdminToken != "" {
+		cfg.Auth.AdminToken = "<hidden>"
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
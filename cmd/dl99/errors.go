@@ -0,0 +1,128 @@
+package main
+
+import (
+	"dl99"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+var errInvalidAdminToken = errors.New("invalid admin token")
+
+// apiError is the body of every failed request.
+type apiError struct {
+	// machine readable, stable across releases, unlike Message
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorStatus struct {
+	status int
+	code   string
+}
+
+// errorStatuses gives every error of the dl99 package, and ours, a status
+// and a code. ErrWin and ErrLose are outcomes rather than failures, see
+// playResult.
+var errorStatuses = map[error]errorStatus{
+	// accounts
+	dl99.ErrInvalidUsername:    {http.StatusBadRequest, "invalid_username"},
+	dl99.ErrWeakPassword:       {http.StatusBadRequest, "weak_password"},
+	dl99.ErrUsernameTaken:      {http.StatusConflict, "username_taken"},
+	dl99.ErrAccountNotFound:    {http.StatusNotFound, "account_not_found"},
+	dl99.ErrInvalidCredentials: {http.StatusUnauthorized, "invalid_credentials"},
+	dl99.ErrSessionNotFound:    {http.StatusUnauthorized, "session_not_found"},
+	dl99.ErrInvalidToken:       {http.StatusUnauthorized, "invalid_token"},
+
+	// players and games
+	dl99.ErrTooMuchPlayers:         {http.StatusServiceUnavailable, "too_many_players"},
+	dl99.ErrTooMuchGames:           {http.StatusServiceUnavailable, "too_many_games"},
+	dl99.ErrServerDraining:         {http.StatusServiceUnavailable, "server_draining"},
+	dl99.ErrPlayerNotFound:         {http.StatusNotFound, "player_not_found"},
+	dl99.ErrGameNotFound:           {http.StatusNotFound, "game_not_found"},
+	dl99.ErrArchiveNotFound:        {http.StatusNotFound, "archive_not_found"},
+	dl99.ErrYouAreNotInThisGame:    {http.StatusForbidden, "not_in_game"},
+	dl99.ErrPlayerNotInThisGame:    {http.StatusConflict, "player_not_in_game"},
+	dl99.ErrPlayerAlreadyJoined:    {http.StatusConflict, "player_already_joined"},
+	dl99.ErrInvalidGameState:       {http.StatusConflict, "invalid_game_state"},
+	dl99.ErrInSufficientPlayers:    {http.StatusConflict, "insufficient_players"},
+	dl99.ErrInsufficientCards:      {http.StatusConflict, "insufficient_cards"},
+	dl99.ErrYouAreNotCurrentPlayer: {http.StatusConflict, "not_your_turn"},
+	dl99.ErrInvalidHandCard:        {http.StatusBadRequest, "invalid_hand_card"},
+	dl99.ErrInvalidCardOption:      {http.StatusBadRequest, "invalid_card_option"},
+	dl99.ErrInvalidRank:            {http.StatusBadRequest, "invalid_rank"},
+	dl99.ErrGamePaused:             {http.StatusConflict, "game_paused"},
+	dl99.ErrGameNotPaused:          {http.StatusConflict, "game_not_paused"},
+	dl99.ErrVersionMismatch:        {http.StatusPreconditionFailed, "precondition_failed"},
+	dl99.ErrWin:                    {http.StatusOK, "win"},
+	dl99.ErrLose:                   {http.StatusOK, "lose"},
+
+	// private games
+	dl99.ErrHostRequired:   {http.StatusBadRequest, "host_required"},
+	dl99.ErrNotHost:        {http.StatusForbidden, "not_host"},
+	dl99.ErrPrivateGame:    {http.StatusForbidden, "private_game"},
+	dl99.ErrNotPrivateGame: {http.StatusConflict, "not_private_game"},
+	dl99.ErrNotInvited:     {http.StatusForbidden, "not_invited"},
+	dl99.ErrAlreadyInvited: {http.StatusConflict, "already_invited"},
+
+	// chat and spectators
+	dl99.ErrEmptyChatMessage:   {http.StatusBadRequest, "empty_chat_message"},
+	dl99.ErrChatMessageTooLong: {http.StatusBadRequest, "chat_message_too_long"},
+	dl99.ErrChatRateLimited:    {http.StatusTooManyRequests, "chat_rate_limited"},
+	dl99.ErrNotGameMember:      {http.StatusForbidden, "not_game_member"},
+	dl99.ErrAlreadySpectating:  {http.StatusConflict, "already_spectating"},
+	dl99.ErrNotSpectating:      {http.StatusConflict, "not_spectating"},
+
+	// leaderboard and matchmaking
+	dl99.ErrInvalidLeaderboardMetric: {http.StatusBadRequest, "invalid_leaderboard_metric"},
+	dl99.ErrInvalidLeaderboardWindow: {http.StatusBadRequest, "invalid_leaderboard_window"},
+	dl99.ErrInvalidTableSize:         {http.StatusBadRequest, "invalid_table_size"},
+	dl99.ErrInvalidRuleSet:           {http.StatusBadRequest, "invalid_rule_set"},
+	dl99.ErrAlreadyQueued:            {http.StatusConflict, "already_queued"},
+	dl99.ErrNotQueued:                {http.StatusConflict, "not_queued"},
+
+	// a stream that fell behind is gone
+	dl99.ErrSubscriberDropped: {http.StatusGone, "subscriber_dropped"},
+
+	errTooManyRequests:    {http.StatusTooManyRequests, "too_many_requests"},
+	errInvalidAdminToken:  {http.StatusUnauthorized, "invalid_admin_token"},
+	errInvalidStateChange: {http.StatusBadRequest, "invalid_state_change"},
+	errUnknownCommand:     {http.StatusBadRequest, "unknown_command"},
+}
+
+// errorCode is err's code, or one made of status for the errors not in
+// errorStatuses, like "bad_request".
+func errorCode(status int, err error) (int, string) {
+	// some errors, like binding's validator.ValidationErrors, are slices
+	// and can't be map keys
+	if reflect.TypeOf(err).Comparable() {
+		if known, ok := errorStatuses[err]; ok {
+			return known.status, known.code
+		}
+	}
+	return status, strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// abortWithError ends the request with err as an apiError, with err's own
+// status if it has one, else status.
+func abortWithError(c *gin.Context, status int, err error) {
+	status, code := errorCode(status, err)
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(status, apiError{Code: code, Message: err.Error()})
+}
+
+// playResult tells how a move went, err is nil, ErrWin or ErrLose, ok is
+// false for any other error.
+func playResult(err error) (result string, ok bool) {
+	switch err {
+	case nil:
+		return "ok", true
+	case dl99.ErrWin:
+		return "win", true
+	case dl99.ErrLose:
+		return "lose", true
+	}
+	return "", false
+}
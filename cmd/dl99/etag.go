@@ -0,0 +1,87 @@
+package main
+
+import (
+	"dl99"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ifVersionKey holds the game version If-Match expects, see ifVersion.
+const ifVersionKey = "dl99.if_version"
+
+// gameLookup is what If-Match needs from the server.
+type gameLookup interface {
+	GameInfo(gameId string) (dl99.GameDetail, error)
+}
+
+// gameETag is the ETag of the game, and of the players in it, their hands
+// only change with the game's version.
+func gameETag(gameId string, version uint64) string {
+	return `"` + gameId + "." + strconv.FormatUint(version, 10) + `"`
+}
+
+// setPlayerETag sets the ETag of a player in a game, players in no game
+// have none.
+func setPlayerETag(srv gameLookup, c *gin.Context, player dl99.PlayerDetail) {
+	if player.GameId == "" {
+		return
+	}
+	if game, err := srv.GameInfo(player.GameId); err == nil {
+		c.Header("ETag", gameETag(game.Id, game.Version))
+	}
+}
+
+// ifMatch rejects the request with 412 if it has an If-Match header none of
+// whose ETags is the game's current one, or the game is gone, so clients
+// don't act on a stale view. The game may still change before the handler runs its command, so
+// the matched version is kept for the handler to pass on, see ifVersion.
+func ifMatch(srv gameLookup, gameIdOf func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("If-Match")
+		if header == "" {
+			return
+		}
+		game, err := srv.GameInfo(gameIdOf(c))
+		if err != nil {
+			// nothing to match, not even *
+			abortWithError(c, http.StatusPreconditionFailed, dl99.ErrVersionMismatch)
+			return
+		}
+		current := gameETag(game.Id, game.Version)
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			// weak tags never match, If-Match compares strongly
+			if tag == "*" {
+				return
+			}
+			if tag == current {
+				c.Set(ifVersionKey, game.Version)
+				return
+			}
+		}
+		c.Header("ETag", current)
+		abortWithError(c, http.StatusPreconditionFailed, dl99.ErrVersionMismatch)
+	}
+}
+
+// ifVersion is the game version ifMatch matched, nil if there was no
+// precondition. The server checks it again as it runs the command, failing
+// with ErrVersionMismatch if the game changed since.
+func ifVersion(c *gin.Context) *uint64 {
+	value, ok := c.Get(ifVersionKey)
+	if !ok {
+		return nil
+	}
+	version := value.(uint64)
+	return &version
+}
+
+func gameIdParam(c *gin.Context) string {
+	return c.Param("game_id")
+}
+
+func gameIdForm(c *gin.Context) string {
+	return c.PostForm("game_id")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"dl99"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// The reads and the socket are the same under the v1 paths and the /v2
+// ones, both route sets use the handlers here so they can't drift apart.
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 60 * time.Second
+)
+
+// waitQuery is the long poll of a game.
+type waitQuery struct {
+	WaitForVersion *uint64       `form:"wait_for_version"`
+	Timeout        time.Duration `form:"timeout"`
+}
+
+// readServer is what the shared reads need from the server.
+type readServer interface {
+	GameInfo(gameId string) (dl99.GameDetail, error)
+	WaitGame(ctx context.Context, gameId string, version uint64, timeout time.Duration) (dl99.GameDetail, error)
+	PlayerInfo(playerId string) (dl99.PlayerDetail, error)
+	PlayerStats(playerId string) (dl99.PlayerStats, error)
+	History(query dl99.HistoryQuery) (dl99.History, error)
+	GameArchive(gameId string) (dl99.GameArchive, error)
+	Leaderboard(query dl99.LeaderboardQuery) (dl99.Leaderboard, error)
+}
+
+// socketServer is what a player's websocket needs from the server.
+type socketServer interface {
+	gameServer
+	Authenticate(playerId string, token string) error
+}
+
+// getGame answers with the game and its ETag. With wait_for_version it
+// blocks until the game's version is past it, timeout runs out or stop is
+// closed.
+func getGame(srv readServer, stop <-chan struct{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query waitQuery
+		if err := c.ShouldBindQuery(&query); err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		var gameDetail dl99.GameDetail
+		var err error
+		if query.WaitForVersion != nil {
+			timeout := query.Timeout
+			if timeout <= 0 {
+				timeout = defaultWaitTimeout
+			}
+			if timeout > maxWaitTimeout {
+				timeout = maxWaitTimeout
+			}
+			ctx, cancel := untilShutdown(c, stop)
+			gameDetail, err = srv.WaitGame(ctx, c.Param("game_id"), *query.WaitForVersion, timeout)
+			cancel()
+		} else {
+			gameDetail, err = srv.GameInfo(c.Param("game_id"))
+		}
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("ETag", gameETag(gameDetail.Id, gameDetail.Version))
+		c.JSON(http.StatusOK, gameDetail)
+	}
+}
+
+// getPlayer answers with the player, the ETag is their game's.
+func getPlayer(srv readServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		playerDetail, err := srv.PlayerInfo(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		setPlayerETag(srv, c, playerDetail)
+		c.JSON(http.StatusOK, playerDetail)
+	}
+}
+
+func getPlayerStats(srv readServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := srv.PlayerStats(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	}
+}
+
+// getHistory searches the finished games.
+func getHistory(srv readServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query dl99.HistoryQuery
+		if err := c.ShouldBindQuery(&query); err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		history, err := srv.History(query)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, history)
+	}
+}
+
+// getArchive answers with a finished game and its moves.
+func getArchive(srv readServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		archive, err := srv.GameArchive(c.Param("game_id"))
+		if err != nil {
+			abortWithError(c, http.StatusNotFound, err)
+			return
+		}
+		c.JSON(http.StatusOK, archive)
+	}
+}
+
+func getLeaderboard(srv readServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query dl99.LeaderboardQuery
+		if err := c.ShouldBindQuery(&query); err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		board, err := srv.Leaderboard(query)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		c.JSON(http.StatusOK, board)
+	}
+}
+
+// openSocket authenticates the player and upgrades to their websocket, the
+// token may also come as a subprotocol, see socketToken. Commands spend
+// from limiter.
+func openSocket(srv socketServer, limiter *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		playerId := c.Param("player_id")
+		token := playerToken(c)
+		if token == "" {
+			token = socketToken(c.Request)
+		}
+		if err := srv.Authenticate(playerId, token); err != nil {
+			abortWithError(c, http.StatusUnauthorized, err)
+			return
+		}
+		_ = srv.Heartbeat(playerId)
+		serveWebSocket(srv, limiter, c, playerId)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"dl99"
 	"errors"
 	"flag"
@@ -9,32 +10,127 @@ import (
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var (
-	serverHost = flag.String("host", "0.0.0.0", "the server host")
-	serverPort = flag.Int("port", 9999, "the server port")
-	maxPlayers = flag.Int("max-players", dl99.DefaultMaxPlayers, "max players")
-	maxGames   = flag.Int("max-games", dl99.DefaultMaxGames, "max game")
+	configPath  = flag.String("config", "", "YAML config file, see dl99.yaml")
+	printConfig = flag.Bool("print-config", false, "print the effective config and exit")
 )
 
 func main() {
+	cfg := defaultConfig()
+	cfg.bindFlags(flag.CommandLine)
 	flag.Parse()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			log.Fatalf("load config failed: %v", err)
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		log.Fatalf("load config from environment failed: %v", err)
+	}
+	// again, so the command line wins over the file and the environment
+	_ = flag.CommandLine.Parse(os.Args[1:])
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		if err := cfg.print(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	startedAt := time.Now()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	srv := dl99.NewServer(*maxPlayers, *maxGames)
+	var store dl99.Store
+	switch cfg.Store.Kind {
+	case "memory":
+		store = dl99.NewMemoryStore()
+	case "bolt":
+		var err error
+		if store, err = dl99.OpenBoltStore(cfg.Store.Path); err != nil {
+			log.Fatalf("open bolt store failed: %v", err)
+		}
+	default:
+		log.Fatalf("unknown store: %s", cfg.Store.Kind)
+	}
+
+	srv := dl99.NewServer(cfg.Limits.MaxPlayers, cfg.Limits.MaxGames, store)
+	// before replaying, the clean ups in the command log prune by it
+	srv.SetArchiveRetention(cfg.Cleanup.ArchiveMax, cfg.Cleanup.ArchiveMaxAge)
+	srv.SetCleanupPolicy(dl99.CleanupPolicy{
+		CreatedTTL:  cfg.Cleanup.CreatedTTL,
+		InactiveTTL: cfg.Cleanup.InactiveTTL,
+		FinishedTTL: cfg.Cleanup.FinishedTTL,
+	})
+	if cfg.Store.DataDir != "" {
+		if err := srv.EnablePersistence(cfg.Store.DataDir); err != nil {
+			log.Fatalf("enable persistence failed: %v", err)
+		}
+	}
+
+	srv.SetRatingBand(cfg.Matchmaking.RatingBand, cfg.Matchmaking.BandWiden)
+	srv.SetSessionTTL(cfg.Auth.SessionTTL)
+
+	srv.SetPresencePolicy(dl99.PresencePolicy{
+		GracePeriod:  cfg.Presence.Grace,
+		Turns:        cfg.Presence.Turns,
+		ForfeitAfter: cfg.Presence.Forfeit,
+	})
+
+	createLimiter := newRateLimiter(cfg.Limits.CreateRate, cfg.Limits.CreateBurst)
+	playLimiter := newRateLimiter(cfg.Limits.PlayRate, cfg.Limits.PlayBurst)
+
+	tickerDone := make(chan struct{})
 	go func() {
-		t := time.NewTicker(time.Minute)
+		defer close(tickerDone)
+
+		t := time.NewTicker(cfg.Cleanup.Interval)
 		defer t.Stop()
 
+		mt := time.NewTicker(cfg.Matchmaking.Interval)
+		defer mt.Stop()
+
+		st := time.NewTicker(cfg.Store.SnapshotInterval)
+		defer st.Stop()
+
+		pt := time.NewTicker(cfg.Presence.Interval)
+		defer pt.Stop()
+
 		for {
 			select {
 			case <-t.C:
-				log.Printf("cleaned %d finished games\n", srv.CleanUpFinishedGame())
+				report := srv.CleanUpGames()
+				for _, game := range report.Games {
+					log.Printf("cleaned %s game [%s] %s, released %v\n", game.Reason, game.Id, game.Name, game.Released)
+				}
+				if report.ArchivesPruned > 0 {
+					log.Printf("pruned %d archived games\n", report.ArchivesPruned)
+				}
+				createLimiter.sweep(time.Now())
+				playLimiter.sweep(time.Now())
+			case <-mt.C:
+				if n := srv.Matchmake(); n > 0 {
+					log.Printf("matchmaking started %d games\n", n)
+				}
+			case <-pt.C:
+				report := srv.CheckPresence()
+				if n := len(report.Skipped) + len(report.Forfeited); n > 0 {
+					log.Printf("presence skipped %v, forfeited %v\n", report.Skipped, report.Forfeited)
+				}
+			case <-st.C:
+				if err := srv.Snapshot(); err != nil {
+					log.Printf("snapshot failed: %v", err)
+				}
 			case <-ctx.Done():
 				log.Println("exit")
 				return
@@ -42,24 +138,112 @@ func main() {
 		}
 	}()
 
+	// closed once the HTTP server shuts down, requests that could go on for
+	// long end then instead of holding up the shutdown
+	shuttingDown := make(chan struct{})
+
 	r := gin.Default()
+	// the rate limits key on the client address, which a client could pick
+	// by itself with the forwarded headers
+	r.ForwardedByClientIP = cfg.Server.BehindProxy
+	r.NoRoute(func(c *gin.Context) {
+		abortWithError(c, http.StatusNotFound, errors.New("no such route"))
+	})
+
+	// requireToken rejects the request unless it carries the token of the
+	// player picked by playerIdOf
+	requireToken := func(playerIdOf func(c *gin.Context) string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			playerId := playerIdOf(c)
+			if err := srv.Authenticate(playerId, playerToken(c)); err != nil {
+				abortWithError(c, http.StatusUnauthorized, err)
+				return
+			}
+			// any authenticated request shows the player is still there
+			_ = srv.Heartbeat(playerId)
+		}
+	}
+	playerIdParam := func(c *gin.Context) string {
+		return c.Param("player_id")
+	}
+	playerIdForm := func(c *gin.Context) string {
+		return c.PostForm("player_id")
+	}
+
+	// API docs, see apiRoutes
+	spec := openAPI(apiRoutes)
+	r.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	})
+	r.GET("/docs", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		if err := docsPage.Execute(c.Writer, docsSections(apiRoutes)); err != nil {
+			_ = c.Error(err)
+		}
+	})
 
 	// new player
-	r.POST("/player", func(c *gin.Context) {
-		if playerId, err := srv.NewPlayer(c.PostForm("name")); err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+	r.POST("/player", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		if playerId, token, err := srv.NewPlayer(c.PostForm("name"), c.PostForm("bot") == "true"); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		} else {
 			c.JSON(http.StatusOK, gin.H{
 				"player_id": playerId,
+				"token":     token,
 			})
 		}
 	})
 
+	// register account
+	r.POST("/register", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		if playerId, err := srv.Register(c.PostForm("username"), c.PostForm("password")); err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		} else {
+			c.JSON(http.StatusOK, gin.H{
+				"player_id": playerId,
+			})
+		}
+	})
+
+	// login, the returned token is used like a guest player token
+	r.POST("/login", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		if playerId, token, err := srv.Login(c.PostForm("username"), c.PostForm("password")); err != nil {
+			abortWithError(c, http.StatusUnauthorized, err)
+			return
+		} else {
+			c.JSON(http.StatusOK, gin.H{
+				"player_id": playerId,
+				"token":     token,
+			})
+		}
+	})
+
+	// logout
+	r.POST("/logout", func(c *gin.Context) {
+		if err := srv.Logout(playerToken(c)); err != nil {
+			abortWithError(c, http.StatusUnauthorized, err)
+			return
+		}
+	})
+
 	// new game
-	r.POST("/game", func(c *gin.Context) {
-		if gameId, err := srv.NewGame(c.PostForm("name")); err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+	r.POST("/game", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		options := dl99.GameOptions{
+			HostId:   c.PostForm("host_id"),
+			Private:  c.PostForm("private") == "true",
+			Password: c.PostForm("password"),
+		}
+		if options.HostId != "" {
+			if err := srv.Authenticate(options.HostId, playerToken(c)); err != nil {
+				abortWithError(c, http.StatusUnauthorized, err)
+				return
+			}
+		}
+		if gameId, err := srv.NewGame(c.PostForm("name"), options); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		} else {
 			c.JSON(http.StatusOK, gin.H{
@@ -76,80 +260,718 @@ func main() {
 	})
 
 	// join game
-	r.POST("/join/:game_id/:player_id", func(c *gin.Context) {
-		if err := srv.JoinGame(c.Param("game_id"), c.Param("player_id")); err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+	r.POST("/join/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		err := srv.JoinGame(c.Param("game_id"), c.Param("player_id"), c.PostForm("invite_code"), c.PostForm("password"), ifVersion(c))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
 	})
 
 	// leave game
-	r.POST("/leave/:game_id/:player_id", func(c *gin.Context) {
-		if err := srv.LeaveGame(c.Param("game_id"), c.Param("player_id")); err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+	r.POST("/leave/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		err := srv.LeaveGame(c.Param("game_id"), c.Param("player_id"), ifVersion(c))
+		result, ok := playResult(err)
+		if !ok {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"result": result})
 	})
 
 	// start game
-	r.POST("/start_game", func(c *gin.Context) {
+	r.POST("/start_game", requireToken(playerIdForm), rateLimit(playLimiter, playerIdForm), ifMatch(srv, gameIdForm), func(c *gin.Context) {
 		gameId, ok := c.GetPostForm("game_id")
 		if !ok {
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("missing game_id"))
+			abortWithError(c, http.StatusBadRequest, errors.New("missing game_id"))
 			return
 		}
 
 		playerId, ok := c.GetPostForm("player_id")
 		if !ok {
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("missing player_id"))
+			abortWithError(c, http.StatusBadRequest, errors.New("missing player_id"))
 			return
 		}
 
-		if err := srv.StartGame(gameId, playerId); err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		if err := srv.StartGame(gameId, playerId, ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
 	})
 
 	// game info
-	r.GET("/game/:game_id", func(c *gin.Context) {
-		gameDetail, err := srv.GameInfo(c.Param("game_id"))
+	// with wait_for_version, blocks until the game's version is past it,
+	// or timeout runs out
+	r.GET("/game/:game_id", getGame(srv, shuttingDown))
+
+	// public events of a game as server-sent events
+	r.GET("/game/:game_id/stream", func(c *gin.Context) {
+		serveGameStream(srv, c, shuttingDown)
+	})
+
+	// player info
+	r.GET("/player/:player_id", requireToken(playerIdParam), getPlayer(srv))
+
+	// player stats
+	r.GET("/player/:player_id/stats", getPlayerStats(srv))
+
+	// heartbeat, keeps the player from being disconnected
+	r.POST("/heartbeat/:player_id", requireToken(playerIdParam), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"presence": dl99.PresenceOnline})
+	})
+
+	// leaderboard
+	r.GET("/leaderboard", getLeaderboard(srv))
+
+	// search finished games
+	r.GET("/history", getHistory(srv))
+
+	// a finished game with its moves
+	r.GET("/history/:game_id", getArchive(srv))
+
+	// enqueue for matchmaking
+	r.POST("/matchmaking/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), func(c *gin.Context) {
+		tableSize, err := strconv.Atoi(c.DefaultPostForm("table_size", strconv.Itoa(cfg.Matchmaking.DefaultTableSize)))
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			abortWithError(c, http.StatusBadRequest, errors.New("invalid table_size"))
+			return
+		}
+		if err := srv.Enqueue(c.Param("player_id"), tableSize, c.DefaultPostForm("rule_set", cfg.Matchmaking.DefaultRuleSet)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
-		c.JSON(http.StatusOK, gameDetail)
 	})
 
-	// player info
-	r.GET("/player/:player_id", func(c *gin.Context) {
-		playerDetail, err := srv.PlayerInfo(c.Param("player_id"))
+	// matchmaking status, game_id is set once matched
+	r.GET("/matchmaking/:player_id", requireToken(playerIdParam), func(c *gin.Context) {
+		status, err := srv.MatchStatus(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	})
+
+	// leave matchmaking queue
+	r.DELETE("/matchmaking/:player_id", requireToken(playerIdParam), func(c *gin.Context) {
+		if err := srv.Dequeue(c.Param("player_id")); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	})
+
+	// invite code of a private game, host only
+	r.GET("/invite_code/:game_id/:player_id", requireToken(playerIdParam), func(c *gin.Context) {
+		code, err := srv.InviteCode(c.Param("game_id"), c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"invite_code": code,
+		})
+	})
+
+	// regenerate invite code of a private game, host only
+	r.POST("/invite_code/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		code, err := srv.RegenerateInviteCode(c.Param("game_id"), c.Param("player_id"), ifVersion(c))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"invite_code": code,
+		})
+	})
+
+	// invite a player to a private game, host only
+	r.POST("/invite/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		inviteeId, ok := c.GetPostForm("invitee_id")
+		if !ok {
+			abortWithError(c, http.StatusBadRequest, errors.New("missing invitee_id"))
+			return
+		}
+		if err := srv.Invite(c.Param("game_id"), c.Param("player_id"), inviteeId, ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	})
+
+	// pending invitations, accept one by joining the game
+	r.GET("/invitations/:player_id", requireToken(playerIdParam), func(c *gin.Context) {
+		invitations, err := srv.Invitations(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"invitations": invitations,
+		})
+	})
+
+	// decline invitation
+	r.POST("/decline/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		if err := srv.DeclineInvitation(c.Param("game_id"), c.Param("player_id"), ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	})
+
+	// spectate game
+	r.POST("/spectate/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		err := srv.Spectate(c.Param("game_id"), c.Param("player_id"), c.PostForm("invite_code"), c.PostForm("password"), ifVersion(c))
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	})
+
+	// stop spectating game
+	r.DELETE("/spectate/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		if err := srv.Unspectate(c.Param("game_id"), c.Param("player_id"), ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	})
+
+	// post chat message
+	r.POST("/chat/:game_id/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), func(c *gin.Context) {
+		if err := srv.PostChat(c.Param("game_id"), c.Param("player_id"), c.PostForm("text")); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
-		c.JSON(http.StatusOK, playerDetail)
 	})
 
+	// read chat messages after since
+	r.GET("/chat/:game_id/:player_id", requireToken(playerIdParam), func(c *gin.Context) {
+		since, err := strconv.ParseUint(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, errors.New("invalid since"))
+			return
+		}
+		messages, err := srv.ChatMessages(c.Param("game_id"), c.Param("player_id"), since)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"messages": messages,
+		})
+	})
+
+	// real-time events and commands of a player
+	r.GET("/ws/:player_id", openSocket(srv, playLimiter))
+
 	// play card
-	r.POST("/play/:game_id/:player_id/:card_index", func(c *gin.Context) {
+	r.POST("/play/:game_id/:player_id/:card_index", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
 		cardIndex, err := strconv.ParseInt(c.Param("card_index"), 10, 32)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("invalid card_index"))
+			abortWithError(c, http.StatusBadRequest, errors.New("invalid card_index"))
 			return
 		}
 		var cardOption dl99.CardOption
 		if err := c.ShouldBind(&cardOption); err != nil {
-			_ = c.AbortWithError(http.StatusBadRequest, err)
+			abortWithError(c, http.StatusBadRequest, err)
 			return
 		}
-		if err := srv.PlayCard(c.Param("game_id"), c.Param("player_id"), int(cardIndex), &cardOption); err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		err = srv.PlayCard(c.Param("game_id"), c.Param("player_id"), int(cardIndex), &cardOption, ifVersion(c))
+		result, ok := playResult(err)
+		if !ok {
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"result": result})
 	})
 
-	if err := r.Run(fmt.Sprintf("%s:%d", *serverHost, *serverPort)); err != nil {
-		log.Println(err)
+	v2 := r.Group("/v2")
+
+	// v2 players
+	v2.POST("/players", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		var req v2PlayerRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		playerId, token, err := srv.NewPlayer(req.Name, req.Bot)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, playerCreated{PlayerId: playerId, Token: token})
+	})
+
+	v2.GET("/players/:player_id", requireToken(playerIdParam), getPlayer(srv))
+
+	v2.GET("/players/:player_id/stats", getPlayerStats(srv))
+
+	// the heartbeat, requireToken does it
+	v2.PUT("/players/:player_id/presence", requireToken(playerIdParam), func(c *gin.Context) {
+		c.JSON(http.StatusOK, presenceStatus{Presence: dl99.PresenceOnline})
+	})
+
+	v2.GET("/players/:player_id/invitations", requireToken(playerIdParam), func(c *gin.Context) {
+		invitations, err := srv.Invitations(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, invitationList{Invitations: invitations})
+	})
+
+	// decline, accepting is joining the game
+	v2.DELETE("/players/:player_id/invitations/:game_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		if err := srv.DeclineInvitation(c.Param("game_id"), c.Param("player_id"), ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	v2.PUT("/players/:player_id/matchmaking", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), func(c *gin.Context) {
+		var req v2MatchRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.TableSize == 0 {
+			req.TableSize = cfg.Matchmaking.DefaultTableSize
+		}
+		if req.RuleSet == "" {
+			req.RuleSet = cfg.Matchmaking.DefaultRuleSet
+		}
+		if err := srv.Enqueue(c.Param("player_id"), req.TableSize, req.RuleSet); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		status, err := srv.MatchStatus(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	})
+
+	v2.GET("/players/:player_id/matchmaking", requireToken(playerIdParam), func(c *gin.Context) {
+		status, err := srv.MatchStatus(c.Param("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	})
+
+	v2.DELETE("/players/:player_id/matchmaking", requireToken(playerIdParam), func(c *gin.Context) {
+		if err := srv.Dequeue(c.Param("player_id")); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	v2.GET("/players/:player_id/socket", openSocket(srv, playLimiter))
+
+	// v2 accounts and sessions
+	v2.POST("/accounts", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		var req v2CredentialsRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		playerId, err := srv.Register(req.Username, req.Password)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		c.JSON(http.StatusCreated, accountCreated{PlayerId: playerId})
+	})
+
+	v2.POST("/sessions", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		var req v2CredentialsRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		playerId, token, err := srv.Login(req.Username, req.Password)
+		if err != nil {
+			abortWithError(c, http.StatusUnauthorized, err)
+			return
+		}
+		c.JSON(http.StatusCreated, playerCreated{PlayerId: playerId, Token: token})
+	})
+
+	// the session of the request's token
+	v2.DELETE("/sessions", func(c *gin.Context) {
+		if err := srv.Logout(playerToken(c)); err != nil {
+			abortWithError(c, http.StatusUnauthorized, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// v2 games
+	v2.GET("/games", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gameList{Games: srv.GameBriefs()})
+	})
+
+	v2.POST("/games", rateLimit(createLimiter, nil), func(c *gin.Context) {
+		var req v2GameRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.HostId != "" {
+			if err := srv.Authenticate(req.HostId, playerToken(c)); err != nil {
+				abortWithError(c, http.StatusUnauthorized, err)
+				return
+			}
+		}
+		gameId, err := srv.NewGame(req.Name, dl99.GameOptions{
+			HostId:   req.HostId,
+			Private:  req.Private,
+			Password: req.Password,
+		})
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gameCreated{GameId: gameId})
+	})
+
+	v2.GET("/games/:game_id", getGame(srv, shuttingDown))
+
+	// start the game
+	v2.PATCH("/games/:game_id", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		var req v2GameUpdate
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.State != dl99.GameStarted {
+			abortWithError(c, http.StatusBadRequest, errInvalidStateChange)
+			return
+		}
+		if err := srv.StartGame(c.Param("game_id"), req.PlayerId, ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		gameDetail, err := srv.GameInfo(c.Param("game_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("ETag", gameETag(gameDetail.Id, gameDetail.Version))
+		c.JSON(http.StatusOK, gameDetail)
+	})
+
+	v2.GET("/games/:game_id/events", func(c *gin.Context) {
+		serveGameStream(srv, c, shuttingDown)
+	})
+
+	// join
+	v2.POST("/games/:game_id/players", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		var req v2JoinRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if err := srv.JoinGame(c.Param("game_id"), req.PlayerId, req.InviteCode, req.Password, ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	// leave, losing if the game started
+	v2.DELETE("/games/:game_id/players/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		err := srv.LeaveGame(c.Param("game_id"), c.Param("player_id"), ifVersion(c))
+		result, ok := playResult(err)
+		if !ok {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, playOutcome{Result: result})
+	})
+
+	v2.GET("/games/:game_id/moves", func(c *gin.Context) {
+		moves, err := srv.GameMoves(c.Param("game_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, v2MoveList{Moves: moves})
+	})
+
+	// play a card
+	v2.POST("/games/:game_id/moves", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		var req v2MoveRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.CardOption == nil {
+			req.CardOption = &dl99.CardOption{}
+		}
+		err := srv.PlayCard(c.Param("game_id"), req.PlayerId, *req.CardIndex, req.CardOption, ifVersion(c))
+		result, ok := playResult(err)
+		if !ok {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, playOutcome{Result: result})
+	})
+
+	v2.POST("/games/:game_id/spectators", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		var req v2JoinRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if err := srv.Spectate(c.Param("game_id"), req.PlayerId, req.InviteCode, req.Password, ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	v2.DELETE("/games/:game_id/spectators/:player_id", requireToken(playerIdParam), rateLimit(playLimiter, playerIdParam), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		if err := srv.Unspectate(c.Param("game_id"), c.Param("player_id"), ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// chat, as seen by the player_id of the query
+	v2.GET("/games/:game_id/messages", requireToken(playerIdQuery), func(c *gin.Context) {
+		since, err := strconv.ParseUint(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, errors.New("invalid since"))
+			return
+		}
+		messages, err := srv.ChatMessages(c.Param("game_id"), c.Query("player_id"), since)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, chatMessages{Messages: messages})
+	})
+
+	v2.POST("/games/:game_id/messages", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), func(c *gin.Context) {
+		var req v2MessageRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if err := srv.PostChat(c.Param("game_id"), req.PlayerId, req.Text); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	// invite code of a private game, the player_id of the query is the host
+	v2.GET("/games/:game_id/invite_code", requireToken(playerIdQuery), func(c *gin.Context) {
+		code, err := srv.InviteCode(c.Param("game_id"), c.Query("player_id"))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, inviteCode{InviteCode: code})
+	})
+
+	// a new invite code replaces the old one
+	v2.PUT("/games/:game_id/invite_code", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		var req v2HostRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		code, err := srv.RegenerateInviteCode(c.Param("game_id"), req.PlayerId, ifVersion(c))
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, inviteCode{InviteCode: code})
+	})
+
+	v2.POST("/games/:game_id/invitations", requireToken(playerIdJSON), rateLimit(playLimiter, playerIdJSON), ifMatch(srv, gameIdParam), func(c *gin.Context) {
+		var req v2InviteRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if err := srv.Invite(c.Param("game_id"), req.PlayerId, req.InviteeId, ifVersion(c)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	// v2 finished games and rankings
+	v2.GET("/archives", getHistory(srv))
+
+	v2.GET("/archives/:game_id", getArchive(srv))
+
+	v2.GET("/leaderboard", getLeaderboard(srv))
+
+	if cfg.Auth.AdminToken != "" {
+		admin := r.Group("/admin", func(c *gin.Context) {
+			token := c.GetHeader("X-Admin-Token")
+			if token == "" {
+				token = bearerToken(c)
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Auth.AdminToken)) != 1 {
+				abortWithError(c, http.StatusUnauthorized, errInvalidAdminToken)
+				return
+			}
+		})
+
+		// every game with its full state, hands included
+		admin.GET("/games", func(c *gin.Context) {
+			games, err := srv.AdminGames()
+			if err != nil {
+				abortWithError(c, http.StatusInternalServerError, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"games": games,
+			})
+		})
+
+		// end a game without a winner
+		admin.POST("/game/:game_id/end", func(c *gin.Context) {
+			if err := srv.ForceEndGame(c.Param("game_id"), c.PostForm("reason")); err != nil {
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+		})
+
+		admin.POST("/game/:game_id/pause", func(c *gin.Context) {
+			if err := srv.PauseGame(c.Param("game_id")); err != nil {
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+		})
+
+		admin.DELETE("/game/:game_id/pause", func(c *gin.Context) {
+			if err := srv.ResumeGame(c.Param("game_id")); err != nil {
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+		})
+
+		admin.POST("/kick/:game_id/:player_id", func(c *gin.Context) {
+			if err := srv.KickPlayer(c.Param("game_id"), c.Param("player_id")); err != nil {
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+		})
+
+		// clear the game of a player stuck in it
+		admin.POST("/player/:player_id/reset", func(c *gin.Context) {
+			if err := srv.ResetPlayer(c.Param("player_id")); err != nil {
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+		})
+
+		// maintenance notice to every game's chat
+		admin.POST("/broadcast", func(c *gin.Context) {
+			count, err := srv.Broadcast(c.PostForm("text"))
+			if err != nil {
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"games": count,
+			})
+		})
+	}
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+		Handler: r,
+	}
+	httpServer.RegisterOnShutdown(func() {
+		close(shuttingDown)
+	})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("got %s, shutting down", sig)
+	case err := <-serveErr:
+		log.Printf("serve failed: %v", err)
+	}
+
+	// no new games, running ones may finish, a second signal stops waiting
+	srv.Drain()
+	if cfg.Server.DrainTimeout > 0 {
+		deadline := time.After(cfg.Server.DrainTimeout)
+		poll := time.NewTicker(time.Second)
+	wait:
+		for {
+			status, err := srv.Status()
+			if err != nil || status.RunningGames == 0 {
+				break
+			}
+			select {
+			case <-poll.C:
+			case <-deadline:
+				log.Printf("drain timeout, %d games still running", status.RunningGames)
+				break wait
+			case sig := <-signals:
+				log.Printf("got %s, not waiting for running games", sig)
+				break wait
+			}
+		}
+		poll.Stop()
+	}
+
+	// in-flight requests finish, new connections are refused
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown failed: %v", err)
+	}
+	cancelShutdown()
+
+	cancel()
+	<-tickerDone
+
+	snapshot := "skipped, no -data-dir"
+	if cfg.Store.DataDir != "" {
+		snapshot = "ok"
+		if err := srv.Snapshot(); err != nil {
+			snapshot = err.Error()
+		}
+	}
+	status, _ := srv.Status()
+	if err := srv.Close(); err != nil {
+		log.Printf("close failed: %v", err)
+	}
+	log.Printf("shut down after %s: %d players, %d games, %d still running, snapshot %s",
+		time.Since(startedAt).Round(time.Second), status.Players, status.Games, status.RunningGames, snapshot)
+}
+
+// untilShutdown is the request's context, done early once stop is closed.
+func untilShutdown(c *gin.Context, stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// playerToken reads the player token from the X-Player-Token header, or
+// from an "Authorization: Bearer <token>" header.
+func playerToken(c *gin.Context) string {
+	if token := c.GetHeader("X-Player-Token"); token != "" {
+		return token
+	}
+	return bearerToken(c)
+}
+
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
 	}
+	return ""
 }
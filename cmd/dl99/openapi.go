@@ -0,0 +1,659 @@
+package main
+
+import (
+	"dl99"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// apiParam is a query or form parameter.
+type apiParam struct {
+	name        string
+	typ         string
+	description string
+	required    bool
+}
+
+// apiRoute documents a route for the OpenAPI document. Every route
+// registered in main must have one, TestOpenAPIMatchesRoutes checks.
+type apiRoute struct {
+	method string
+	// in gin's syntax, :name is a path parameter
+	path    string
+	tag     string
+	summary string
+	// "player" needs the token of the player_id in the path or form,
+	// "optional" needs it only with host_id, "admin" needs the admin token
+	auth string
+	// the route honors If-Match with the game's ETag
+	ifMatch bool
+	// the response carries the game's ETag
+	etag bool
+
+	// a struct with form tags, and parameters on top of it
+	query        interface{}
+	queryParams  []apiParam
+	headerParams []apiParam
+	form         []apiParam
+	// a value of the JSON body's type
+	body interface{}
+
+	// a value of the response's type, nil for none
+	response interface{}
+	// of the response if not JSON, then response is what each message is
+	contentType string
+	status      int
+}
+
+// the websocket routes take the player token as a subprotocol too, for
+// clients that can't set headers
+var socketParams = []apiParam{
+	{name: "Sec-WebSocket-Protocol", typ: "string", description: `"dl99, token.<player token>", the server answers with "dl99"`},
+}
+
+// small bodies built with gin.H in the handlers
+type (
+	playerCreated struct {
+		PlayerId string `json:"player_id"`
+		Token    string `json:"token"`
+	}
+	accountCreated struct {
+		PlayerId string `json:"player_id"`
+	}
+	gameCreated struct {
+		GameId string `json:"game_id"`
+	}
+	gameList struct {
+		Games []dl99.GameBrief `json:"games"`
+	}
+	playOutcome struct {
+		// "ok", "win" or "lose"
+		Result string `json:"result"`
+	}
+	presenceStatus struct {
+		Presence string `json:"presence"`
+	}
+	inviteCode struct {
+		InviteCode string `json:"invite_code"`
+	}
+	invitationList struct {
+		Invitations []dl99.Invitation `json:"invitations"`
+	}
+	chatMessages struct {
+		Messages []dl99.ChatMessage `json:"messages"`
+	}
+	adminGameList struct {
+		Games []dl99.AdminGame `json:"games"`
+	}
+	broadcastResult struct {
+		// games notified
+		Games int `json:"games"`
+	}
+)
+
+var apiRoutes = []apiRoute{
+	{method: "POST", path: "/player", tag: "players", summary: "Create a guest player",
+		form: []apiParam{
+			{name: "name", typ: "string"},
+			{name: "bot", typ: "boolean"},
+		},
+		response: playerCreated{}},
+	{method: "POST", path: "/register", tag: "players", summary: "Register an account",
+		form: []apiParam{
+			{name: "username", typ: "string", required: true},
+			{name: "password", typ: "string", required: true},
+		},
+		response: accountCreated{}},
+	{method: "POST", path: "/login", tag: "players", summary: "Log in, the token works like a guest player's",
+		form: []apiParam{
+			{name: "username", typ: "string", required: true},
+			{name: "password", typ: "string", required: true},
+		},
+		response: playerCreated{}},
+	{method: "POST", path: "/logout", tag: "players", summary: "Log out, the token stops working", auth: "player"},
+	{method: "GET", path: "/player/:player_id", tag: "players", summary: "A player with their hand", auth: "player", etag: true,
+		response: dl99.PlayerDetail{}},
+	{method: "GET", path: "/player/:player_id/stats", tag: "players", summary: "A player's lifetime statistics",
+		response: dl99.PlayerStats{}},
+	{method: "POST", path: "/heartbeat/:player_id", tag: "players", summary: "Keep the player from being disconnected", auth: "player",
+		response: presenceStatus{}},
+	{method: "GET", path: "/leaderboard", tag: "players", summary: "Rank players",
+		query: dl99.LeaderboardQuery{}, response: dl99.Leaderboard{}},
+
+	{method: "POST", path: "/game", tag: "games", summary: "Create a game", auth: "optional",
+		form: []apiParam{
+			{name: "name", typ: "string"},
+			{name: "host_id", typ: "string", description: "required for private games, authenticated"},
+			{name: "private", typ: "boolean"},
+			{name: "password", typ: "string", description: "makes the game private"},
+		},
+		response: gameCreated{}},
+	{method: "GET", path: "/games", tag: "games", summary: "List public games",
+		response: gameList{}},
+	{method: "GET", path: "/game/:game_id", tag: "games", summary: "A game, optionally waiting for it to change", etag: true,
+		query: waitQuery{}, response: dl99.GameDetail{}},
+	{method: "GET", path: "/game/:game_id/stream", tag: "games", summary: "The game's public events as server-sent events",
+		queryParams: []apiParam{
+			{name: "last_event_id", typ: "integer", description: "like the Last-Event-ID header"},
+		},
+		response: dl99.Event{}, contentType: "text/event-stream"},
+	{method: "POST", path: "/join/:game_id/:player_id", tag: "games", summary: "Join a game", auth: "player", ifMatch: true,
+		form: []apiParam{
+			{name: "invite_code", typ: "string"},
+			{name: "password", typ: "string"},
+		}},
+	{method: "POST", path: "/leave/:game_id/:player_id", tag: "games", summary: "Leave a game, losing if it started", auth: "player", ifMatch: true,
+		response: playOutcome{}},
+	{method: "POST", path: "/start_game", tag: "games", summary: "Start a game", auth: "player", ifMatch: true,
+		form: []apiParam{
+			{name: "game_id", typ: "string", required: true},
+			{name: "player_id", typ: "string", required: true},
+		}},
+	{method: "POST", path: "/play/:game_id/:player_id/:card_index", tag: "games", summary: "Play a card of the hand", auth: "player", ifMatch: true,
+		body: dl99.CardOption{}, response: playOutcome{}},
+
+	{method: "GET", path: "/history", tag: "history", summary: "Search finished games, newest first",
+		query: dl99.HistoryQuery{}, response: dl99.History{}},
+	{method: "GET", path: "/history/:game_id", tag: "history", summary: "A finished game with its moves",
+		response: dl99.GameArchive{}},
+
+	{method: "POST", path: "/matchmaking/:player_id", tag: "matchmaking", summary: "Queue for a game", auth: "player",
+		form: []apiParam{
+			{name: "table_size", typ: "integer"},
+			{name: "rule_set", typ: "string"},
+		}},
+	{method: "GET", path: "/matchmaking/:player_id", tag: "matchmaking", summary: "Whether a game was found", auth: "player",
+		response: dl99.MatchStatus{}},
+	{method: "DELETE", path: "/matchmaking/:player_id", tag: "matchmaking", summary: "Leave the queue", auth: "player"},
+
+	{method: "GET", path: "/invite_code/:game_id/:player_id", tag: "private games", summary: "The invite code, host only", auth: "player",
+		response: inviteCode{}},
+	{method: "POST", path: "/invite_code/:game_id/:player_id", tag: "private games", summary: "Regenerate the invite code, host only", auth: "player", ifMatch: true,
+		response: inviteCode{}},
+	{method: "POST", path: "/invite/:game_id/:player_id", tag: "private games", summary: "Invite a player, host only", auth: "player", ifMatch: true,
+		form: []apiParam{
+			{name: "invitee_id", typ: "string", required: true},
+		}},
+	{method: "GET", path: "/invitations/:player_id", tag: "private games", summary: "Pending invitations, accept one by joining", auth: "player",
+		response: invitationList{}},
+	{method: "POST", path: "/decline/:game_id/:player_id", tag: "private games", summary: "Decline an invitation", auth: "player", ifMatch: true},
+
+	{method: "POST", path: "/spectate/:game_id/:player_id", tag: "chat", summary: "Watch a game", auth: "player", ifMatch: true,
+		form: []apiParam{
+			{name: "invite_code", typ: "string"},
+			{name: "password", typ: "string"},
+		}},
+	{method: "DELETE", path: "/spectate/:game_id/:player_id", tag: "chat", summary: "Stop watching a game", auth: "player", ifMatch: true},
+	{method: "POST", path: "/chat/:game_id/:player_id", tag: "chat", summary: "Post a chat message", auth: "player",
+		form: []apiParam{
+			{name: "text", typ: "string", required: true},
+		}},
+	{method: "GET", path: "/chat/:game_id/:player_id", tag: "chat", summary: "Chat messages after since", auth: "player",
+		queryParams: []apiParam{
+			{name: "since", typ: "integer"},
+		},
+		response: chatMessages{}},
+
+	{method: "GET", path: "/ws/:player_id", tag: "real-time", summary: "WebSocket of the player's events and commands",
+		headerParams: socketParams, response: wsMessage{}, contentType: "application/websocket", status: http.StatusSwitchingProtocols},
+
+	{method: "GET", path: "/admin/games", tag: "admin", summary: "Every game with its full state", auth: "admin",
+		response: adminGameList{}},
+	{method: "POST", path: "/admin/game/:game_id/end", tag: "admin", summary: "End a game without a winner", auth: "admin",
+		form: []apiParam{
+			{name: "reason", typ: "string"},
+		}},
+	{method: "POST", path: "/admin/game/:game_id/pause", tag: "admin", summary: "Pause a game", auth: "admin"},
+	{method: "DELETE", path: "/admin/game/:game_id/pause", tag: "admin", summary: "Resume a game", auth: "admin"},
+	{method: "POST", path: "/admin/kick/:game_id/:player_id", tag: "admin", summary: "Kick a player out of a game", auth: "admin"},
+	{method: "POST", path: "/admin/player/:player_id/reset", tag: "admin", summary: "Clear the game of a player stuck in it", auth: "admin"},
+	{method: "POST", path: "/admin/broadcast", tag: "admin", summary: "Post a maintenance notice to every game", auth: "admin",
+		form: []apiParam{
+			{name: "text", typ: "string", required: true},
+		},
+		response: broadcastResult{}},
+
+	{method: "POST", path: "/v2/players", tag: "v2 players", summary: "Create a guest player",
+		body: v2PlayerRequest{}, response: playerCreated{}, status: http.StatusCreated},
+	{method: "GET", path: "/v2/players/:player_id", tag: "v2 players", summary: "A player with their hand", auth: "player", etag: true,
+		response: dl99.PlayerDetail{}},
+	{method: "GET", path: "/v2/players/:player_id/stats", tag: "v2 players", summary: "A player's lifetime statistics",
+		response: dl99.PlayerStats{}},
+	{method: "PUT", path: "/v2/players/:player_id/presence", tag: "v2 players", summary: "Keep the player from being disconnected", auth: "player",
+		response: presenceStatus{}},
+	{method: "GET", path: "/v2/players/:player_id/invitations", tag: "v2 players", summary: "Pending invitations, accept one by joining", auth: "player",
+		response: invitationList{}},
+	{method: "DELETE", path: "/v2/players/:player_id/invitations/:game_id", tag: "v2 players", summary: "Decline an invitation", auth: "player", ifMatch: true,
+		status: http.StatusNoContent},
+	{method: "PUT", path: "/v2/players/:player_id/matchmaking", tag: "v2 players", summary: "Queue for a game", auth: "player",
+		body: v2MatchRequest{}, response: dl99.MatchStatus{}},
+	{method: "GET", path: "/v2/players/:player_id/matchmaking", tag: "v2 players", summary: "Whether a game was found", auth: "player",
+		response: dl99.MatchStatus{}},
+	{method: "DELETE", path: "/v2/players/:player_id/matchmaking", tag: "v2 players", summary: "Leave the queue", auth: "player",
+		status: http.StatusNoContent},
+	{method: "GET", path: "/v2/players/:player_id/socket", tag: "v2 players", summary: "WebSocket of the player's events and commands",
+		headerParams: socketParams, response: wsMessage{}, contentType: "application/websocket", status: http.StatusSwitchingProtocols},
+	{method: "POST", path: "/v2/accounts", tag: "v2 players", summary: "Register an account",
+		body: v2CredentialsRequest{}, response: accountCreated{}, status: http.StatusCreated},
+	{method: "POST", path: "/v2/sessions", tag: "v2 players", summary: "Log in, the token works like a guest player's",
+		body: v2CredentialsRequest{}, response: playerCreated{}, status: http.StatusCreated},
+	{method: "DELETE", path: "/v2/sessions", tag: "v2 players", summary: "Log out, the token stops working", auth: "player",
+		status: http.StatusNoContent},
+
+	{method: "GET", path: "/v2/games", tag: "v2 games", summary: "List public games",
+		response: gameList{}},
+	{method: "POST", path: "/v2/games", tag: "v2 games", summary: "Create a game", auth: "optional",
+		body: v2GameRequest{}, response: gameCreated{}, status: http.StatusCreated},
+	{method: "GET", path: "/v2/games/:game_id", tag: "v2 games", summary: "A game, optionally waiting for it to change", etag: true,
+		query: waitQuery{}, response: dl99.GameDetail{}},
+	{method: "PATCH", path: "/v2/games/:game_id", tag: "v2 games", summary: "Start a game, state 1", auth: "player", ifMatch: true, etag: true,
+		body: v2GameUpdate{}, response: dl99.GameDetail{}},
+	{method: "GET", path: "/v2/games/:game_id/events", tag: "v2 games", summary: "The game's public events as server-sent events",
+		queryParams: []apiParam{
+			{name: "last_event_id", typ: "integer", description: "like the Last-Event-ID header"},
+		},
+		response: dl99.Event{}, contentType: "text/event-stream"},
+	{method: "POST", path: "/v2/games/:game_id/players", tag: "v2 games", summary: "Join a game", auth: "player", ifMatch: true,
+		body: v2JoinRequest{}, status: http.StatusCreated},
+	{method: "DELETE", path: "/v2/games/:game_id/players/:player_id", tag: "v2 games", summary: "Leave a game, losing if it started", auth: "player", ifMatch: true,
+		response: playOutcome{}},
+	{method: "GET", path: "/v2/games/:game_id/moves", tag: "v2 games", summary: "The cards played so far",
+		response: v2MoveList{}},
+	{method: "POST", path: "/v2/games/:game_id/moves", tag: "v2 games", summary: "Play a card of the hand", auth: "player", ifMatch: true,
+		body: v2MoveRequest{}, response: playOutcome{}, status: http.StatusCreated},
+	{method: "POST", path: "/v2/games/:game_id/spectators", tag: "v2 games", summary: "Watch a game", auth: "player", ifMatch: true,
+		body: v2JoinRequest{}, status: http.StatusCreated},
+	{method: "DELETE", path: "/v2/games/:game_id/spectators/:player_id", tag: "v2 games", summary: "Stop watching a game", auth: "player", ifMatch: true,
+		status: http.StatusNoContent},
+	{method: "GET", path: "/v2/games/:game_id/messages", tag: "v2 games", summary: "Chat messages after since", auth: "player",
+		queryParams: []apiParam{
+			{name: "player_id", typ: "string", required: true},
+			{name: "since", typ: "integer"},
+		},
+		response: chatMessages{}},
+	{method: "POST", path: "/v2/games/:game_id/messages", tag: "v2 games", summary: "Post a chat message", auth: "player",
+		body: v2MessageRequest{}, status: http.StatusCreated},
+	{method: "GET", path: "/v2/games/:game_id/invite_code", tag: "v2 games", summary: "The invite code, host only", auth: "player",
+		queryParams: []apiParam{
+			{name: "player_id", typ: "string", required: true},
+		},
+		response: inviteCode{}},
+	{method: "PUT", path: "/v2/games/:game_id/invite_code", tag: "v2 games", summary: "Regenerate the invite code, host only", auth: "player", ifMatch: true,
+		body: v2HostRequest{}, response: inviteCode{}},
+	{method: "POST", path: "/v2/games/:game_id/invitations", tag: "v2 games", summary: "Invite a player, host only", auth: "player", ifMatch: true,
+		body: v2InviteRequest{}, status: http.StatusCreated},
+
+	{method: "GET", path: "/v2/archives", tag: "v2 archives", summary: "Search finished games, newest first",
+		query: dl99.HistoryQuery{}, response: dl99.History{}},
+	{method: "GET", path: "/v2/archives/:game_id", tag: "v2 archives", summary: "A finished game with its moves",
+		response: dl99.GameArchive{}},
+	{method: "GET", path: "/v2/leaderboard", tag: "v2 archives", summary: "Rank players",
+		query: dl99.LeaderboardQuery{}, response: dl99.Leaderboard{}},
+
+	{method: "GET", path: "/openapi.json", tag: "docs", summary: "This document"},
+	{method: "GET", path: "/docs", tag: "docs", summary: "This document as a web page", contentType: "text/html"},
+}
+
+// openAPI builds the OpenAPI 3 document of routes, the schemas come from
+// the Go types so they can't drift from what's sent.
+func openAPI(routes []apiRoute) gin.H {
+	schemas := &schemaSet{components: gin.H{}}
+	errorSchema := schemas.of(reflect.TypeOf(apiError{}))
+
+	paths := gin.H{}
+	for _, route := range routes {
+		path, pathParams := openAPIPath(route.path)
+		item, ok := paths[path].(gin.H)
+		if !ok {
+			item = gin.H{}
+			paths[path] = item
+		}
+
+		params := make([]gin.H, 0)
+		for _, name := range pathParams {
+			params = append(params, gin.H{
+				"name": name, "in": "path", "required": true,
+				"schema": gin.H{"type": "string"},
+			})
+		}
+		query := route.queryParams
+		if route.query != nil {
+			query = append(formParams(reflect.TypeOf(route.query)), query...)
+		}
+		if route.ifMatch {
+			params = append(params, gin.H{
+				"name": "If-Match", "in": "header", "required": false,
+				"description": "an ETag of the game, the request fails with 412 if the game changed since",
+				"schema":      gin.H{"type": "string"},
+			})
+		}
+		for _, p := range query {
+			params = append(params, gin.H{
+				"name": p.name, "in": "query", "required": p.required,
+				"description": p.description,
+				"schema":      gin.H{"type": p.typ},
+			})
+		}
+		for _, p := range route.headerParams {
+			params = append(params, gin.H{
+				"name": p.name, "in": "header", "required": p.required,
+				"description": p.description,
+				"schema":      gin.H{"type": p.typ},
+			})
+		}
+
+		op := gin.H{
+			"tags":        []string{route.tag},
+			"summary":     route.summary,
+			"operationId": operationId(route),
+			"parameters":  params,
+		}
+		switch route.auth {
+		case "player":
+			op["security"] = []gin.H{{"playerToken": []string{}}, {"bearerToken": []string{}}}
+		case "optional":
+			op["security"] = []gin.H{{}, {"playerToken": []string{}}, {"bearerToken": []string{}}}
+		case "admin":
+			op["security"] = []gin.H{{"adminToken": []string{}}, {"bearerToken": []string{}}}
+		}
+
+		if len(route.form) > 0 {
+			properties := gin.H{}
+			required := make([]string, 0)
+			for _, p := range route.form {
+				properties[p.name] = gin.H{"type": p.typ, "description": p.description}
+				if p.required {
+					required = append(required, p.name)
+				}
+			}
+			form := gin.H{"type": "object", "properties": properties}
+			if len(required) > 0 {
+				form["required"] = required
+			}
+			op["requestBody"] = gin.H{
+				"required": len(required) > 0,
+				"content": gin.H{
+					"application/x-www-form-urlencoded": gin.H{"schema": form},
+				},
+			}
+		}
+		if route.body != nil {
+			op["requestBody"] = gin.H{
+				"content": gin.H{
+					"application/json": gin.H{"schema": schemas.of(reflect.TypeOf(route.body))},
+				},
+			}
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		ok200 := gin.H{"description": http.StatusText(status)}
+		contentType := route.contentType
+		if contentType == "" && route.response != nil {
+			contentType = "application/json"
+		}
+		if route.etag {
+			ok200["headers"] = gin.H{
+				"ETag": gin.H{
+					"description": "changes with the game, for If-Match",
+					"schema":      gin.H{"type": "string"},
+				},
+			}
+		}
+		if contentType != "" {
+			content := gin.H{}
+			if route.response != nil {
+				content["schema"] = schemas.of(reflect.TypeOf(route.response))
+			}
+			ok200["content"] = gin.H{contentType: content}
+		}
+		responses := gin.H{
+			strconv.Itoa(status): ok200,
+			"default": gin.H{
+				"description": "an error, see the code",
+				"content":     gin.H{"application/json": gin.H{"schema": errorSchema}},
+			},
+		}
+		if route.ifMatch {
+			responses[strconv.Itoa(http.StatusPreconditionFailed)] = gin.H{
+				"description": "the game changed since, its ETag is the current one",
+				"content":     gin.H{"application/json": gin.H{"schema": errorSchema}},
+			}
+		}
+		op["responses"] = responses
+		item[strings.ToLower(route.method)] = op
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":   "dl99",
+			"version": "1",
+			"description": "Deadline 99 game server. Mutating requests of a player need the player's token " +
+				"as X-Player-Token or a Bearer token.",
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": schemas.components,
+			"securitySchemes": gin.H{
+				"playerToken": gin.H{"type": "apiKey", "in": "header", "name": "X-Player-Token"},
+				"adminToken":  gin.H{"type": "apiKey", "in": "header", "name": "X-Admin-Token"},
+				"bearerToken": gin.H{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// openAPIPath turns /game/:game_id into /game/{game_id}.
+func openAPIPath(path string) (string, []string) {
+	parts := strings.Split(path, "/")
+	params := make([]string, 0)
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			params = append(params, part[1:])
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// operationId is like postJoinGameIdPlayerId.
+func operationId(route apiRoute) string {
+	id := strings.ToLower(route.method)
+	for _, part := range strings.FieldsFunc(route.path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '_' || r == '.'
+	}) {
+		id += upperFirst(part)
+	}
+	return id
+}
+
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// formParams are the fields of a struct bound with form tags.
+func formParams(t reflect.Type) []apiParam {
+	params := make([]apiParam, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("form")
+		if name == "" || name == "-" {
+			continue
+		}
+		typ := jsonType(field.Type)
+		if field.Type.Kind() == reflect.Ptr {
+			typ = jsonType(field.Type.Elem())
+		}
+		description := ""
+		switch {
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			typ = "string"
+			description = "a duration like 30s"
+		case field.Type == reflect.TypeOf(time.Time{}):
+			description = "a date like " + field.Tag.Get("time_format")
+		}
+		params = append(params, apiParam{name: name, typ: typ, description: description})
+	}
+	return params
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "string"
+}
+
+// schemaSet builds JSON schemas of Go types, the named structs go to
+// components and are referenced.
+type schemaSet struct {
+	components gin.H
+}
+
+func (s *schemaSet) of(t reflect.Type) gin.H {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return gin.H{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(time.Duration(0)):
+		return gin.H{"type": "integer", "description": "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.of(t.Elem())
+	case reflect.Interface:
+		return gin.H{}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := upperFirst(t.Name())
+		ref := gin.H{"$ref": "#/components/schemas/" + name}
+		if _, ok := s.components[name]; !ok {
+			// taken before recursing, for types referencing themselves
+			s.components[name] = gin.H{}
+			s.components[name] = s.object(t)
+		}
+		return ref
+	}
+	return gin.H{"type": jsonType(t)}
+}
+
+func (s *schemaSet) object(t reflect.Type) gin.H {
+	properties := gin.H{}
+	s.fields(t, properties)
+	return gin.H{"type": "object", "properties": properties}
+}
+
+// fields adds the fields of t as encoding/json sees them, embedded structs
+// are flattened.
+func (s *schemaSet) fields(t reflect.Type, properties gin.H) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.fields(field.Type, properties)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.of(field.Type)
+	}
+}
+
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dl99 API</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+code { background: #f4f4f4; padding: 0 .2em; }
+td { padding: .2em .6em; vertical-align: top; }
+.method { font-weight: bold; font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>dl99 API</h1>
+<p>The machine readable document is <a href="/openapi.json">/openapi.json</a>.
+Failed requests answer <code>{"code": ..., "message": ...}</code>.</p>
+{{range .}}
+<h2>{{.Tag}}</h2>
+<table>
+{{range .Routes}}<tr>
+<td class="method">{{.Method}}</td>
+<td><code>{{.Path}}</code></td>
+<td>{{.Summary}}{{if .Auth}} <em>({{.Auth}} token)</em>{{end}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+type docsSection struct {
+	Tag    string
+	Routes []docsRoute
+}
+
+type docsRoute struct {
+	Method, Path, Summary, Auth string
+}
+
+// docsSections groups the routes by tag, in order of appearance.
+func docsSections(routes []apiRoute) []docsSection {
+	sections := make([]docsSection, 0)
+	index := make(map[string]int)
+	for _, route := range routes {
+		i, ok := index[route.tag]
+		if !ok {
+			i = len(sections)
+			index[route.tag] = i
+			sections = append(sections, docsSection{Tag: route.tag})
+		}
+		path, _ := openAPIPath(route.path)
+		sections[i].Routes = append(sections[i].Routes, docsRoute{
+			Method:  route.method,
+			Path:    path,
+			Summary: route.summary,
+			Auth:    route.auth,
+		})
+	}
+	return sections
+}
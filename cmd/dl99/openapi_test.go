@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var routeMethods = map[string]bool{
+	"GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true,
+}
+
+// registeredRoute is a route found in the sources.
+type registeredRoute struct {
+	key string
+	// ifMatch is among its handlers
+	ifMatch bool
+}
+
+// registeredRoutes finds the routes registered in the package's sources,
+// like r.GET("/games", ...), following groups made with r.Group("/admin").
+func registeredRoutes(t *testing.T) []registeredRoute {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := make([]registeredRoute, 0)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			// variable -> path prefix, the engine has none
+			prefixes := make(map[string]string)
+			ast.Inspect(file, func(node ast.Node) bool {
+				switch node := node.(type) {
+				case *ast.AssignStmt:
+					if len(node.Lhs) != 1 || len(node.Rhs) != 1 {
+						return true
+					}
+					name, ok := node.Lhs[0].(*ast.Ident)
+					if !ok {
+						return true
+					}
+					if receiver, method, path, ok := routeCall(node.Rhs[0]); ok && method == "Group" {
+						prefixes[name.Name] = prefixes[receiver] + path
+					}
+				case *ast.CallExpr:
+					if receiver, method, path, ok := routeCall(node); ok && routeMethods[method] {
+						routes = append(routes, registeredRoute{
+							key:     method + " " + prefixes[receiver] + path,
+							ifMatch: callsIfMatch(node.Args[1:]),
+						})
+					}
+				}
+				return true
+			})
+		}
+	}
+	return routes
+}
+
+// routeCall matches receiver.Method("/path", ...).
+func routeCall(expr ast.Expr) (receiver string, method string, path string, ok bool) {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return "", "", "", false
+	}
+	selector, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", "", "", false
+	}
+	ident, ok := selector.X.(*ast.Ident)
+	if !ok {
+		return "", "", "", false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", "", "", false
+	}
+	path, err := strconv.Unquote(lit.Value)
+	if err != nil || !strings.HasPrefix(path, "/") && path != "" {
+		return "", "", "", false
+	}
+	return ident.Name, selector.Sel.Name, path, true
+}
+
+func callsIfMatch(handlers []ast.Expr) bool {
+	for _, handler := range handlers {
+		if call, ok := handler.(*ast.CallExpr); ok {
+			if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == "ifMatch" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	registered := make(map[string]bool)
+	ifMatched := make(map[string]bool)
+	for _, route := range registeredRoutes(t) {
+		if registered[route.key] {
+			t.Errorf("route %s registered twice", route.key)
+		}
+		registered[route.key] = true
+		ifMatched[route.key] = route.ifMatch
+	}
+	if len(registered) == 0 {
+		t.Fatal("no routes found")
+	}
+
+	documented := make(map[string]bool)
+	for _, route := range apiRoutes {
+		key := route.method + " " + route.path
+		if documented[key] {
+			t.Errorf("route %s documented twice", key)
+		}
+		documented[key] = true
+		if registered[key] && ifMatched[key] != route.ifMatch {
+			t.Errorf("route %s honors If-Match: %v, apiRoutes says %v", key, ifMatched[key], route.ifMatch)
+		}
+	}
+
+	var missing, stale []string
+	for route := range registered {
+		if !documented[route] {
+			missing = append(missing, route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			stale = append(stale, route)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+	for _, route := range missing {
+		t.Errorf("route %s is not in apiRoutes", route)
+	}
+	for _, route := range stale {
+		t.Errorf("apiRoutes has %s, which is not registered", route)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	raw, err := json.Marshal(openAPI(apiRoutes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := spec.Paths["/play/{game_id}/{player_id}/{card_index}"]["post"]; !ok {
+		t.Error("POST /play/{game_id}/{player_id}/{card_index} missing")
+	}
+	for _, name := range []string{"GameBrief", "GameDetail", "PlayerDetail", "CardOption", "ApiError"} {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+
+	// every $ref points at a schema
+	for _, ref := range strings.Split(string(raw), `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("dangling $ref to %s", name)
+		}
+	}
+}
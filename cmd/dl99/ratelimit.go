@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTooManyRequests = errors.New("too many requests")
+
+// bucket is a token bucket, refilled continuously.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per key, a remote address or a player
+// id, each allowing burst requests at once and perMinute on average.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// refill brings key's bucket up to now, l.mu must be held.
+func (l *rateLimiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// sweep forgets the buckets that refilled, they'd start full anyway.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// take spends a token of every key's bucket, if one has none it spends
+// nothing and returns how long until they all have one.
+func (l *rateLimiter) take(keys []string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := make([]*bucket, 0, len(keys))
+	ok := true
+	var wait time.Duration
+	for _, key := range keys {
+		b := l.refill(key, now)
+		if b.tokens < 1 {
+			ok = false
+			if w := time.Duration((1 - b.tokens) / l.rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if !ok {
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// limitKeys are the buckets a request spends from, its remote address and
+// the player's, if any. The address is the forwarded one only with
+// server.behind_proxy.
+func limitKeys(c *gin.Context, playerId string) []string {
+	keys := []string{"addr:" + c.ClientIP()}
+	if playerId != "" {
+		keys = append(keys, "player:"+playerId)
+	}
+	return keys
+}
+
+func retryAfter(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// rateLimit rejects the request with 429 once the remote address, or the
+// player picked by playerIdOf if not nil, ran out of l's budget. Put it
+// after requireToken, so nobody spends someone else's budget.
+func rateLimit(l *rateLimiter, playerIdOf func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var playerId string
+		if playerIdOf != nil {
+			playerId = playerIdOf(c)
+		}
+		if ok, wait := l.take(limitKeys(c, playerId), time.Now()); !ok {
+			c.Header("Retry-After", strconv.Itoa(retryAfter(wait)))
+			abortWithError(c, http.StatusTooManyRequests, errTooManyRequests)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	// a token a second, two at once
+	l := newRateLimiter(60, 2)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []string{"addr:192.0.2.1"}
+
+	steps := []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		{time.Second, true, 0},
+		{time.Second, false, time.Second},
+		// refilled up to the burst, no further
+		{time.Minute, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, false, time.Second},
+	}
+	for i, step := range steps {
+		ok, wait := l.take(keys, start.Add(step.after))
+		if ok != step.ok || wait != step.wait {
+			t.Errorf("step %d at %v: %v, %v, want %v, %v", i, step.after, ok, wait, step.ok, step.wait)
+		}
+	}
+}
+
+func TestRateLimiterRejectSpendsNothing(t *testing.T) {
+	l := newRateLimiter(60, 1)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if ok, _ := l.take([]string{"addr:a", "player:p"}, now); !ok {
+		t.Fatal("first request rejected")
+	}
+	// the player is out, the second address isn't charged for it
+	if ok, _ := l.take([]string{"addr:b", "player:p"}, now); ok {
+		t.Fatal("player over budget allowed")
+	}
+	if ok, _ := l.take([]string{"addr:b"}, now); !ok {
+		t.Error("address charged for a rejected request")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Nanosecond, 1},
+		{500 * time.Millisecond, 1},
+		{time.Second, 1},
+		{time.Second + time.Millisecond, 2},
+		{10 * time.Second, 10},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.wait); got != test.want {
+			t.Errorf("retryAfter(%v) = %d, want %d", test.wait, got, test.want)
+		}
+	}
+}
+
+func TestRateLimitRetryAfterHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// a token every 10 seconds
+	r.GET("/", rateLimit(newRateLimiter(6, 1), nil), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	request := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("192.0.2.1:1000"); w.Code != http.StatusNoContent {
+		t.Fatalf("first request: %d", w.Code)
+	}
+	w := request("192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After %q, want 10", got)
+	}
+	// another address has its own budget
+	if w := request("192.0.2.2:1000"); w.Code != http.StatusNoContent {
+		t.Errorf("other address: %d", w.Code)
+	}
+}
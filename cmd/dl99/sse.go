@@ -0,0 +1,122 @@
+package main
+
+import (
+	"dl99"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// a comment line keeps proxies from closing an idle stream
+	sseKeepAlive   = 15 * time.Second
+	sseEventBuffer = 256
+)
+
+// eventStream is what the SSE transport needs from the server.
+type eventStream interface {
+	SubscribeGame(gameId string, afterSeq uint64, buffer int) (*dl99.Subscription, []dl99.Event, bool)
+	GameInfo(gameId string) (dl99.GameDetail, error)
+}
+
+// publicEvent tells whether anyone may see the event, chat is for the
+// members of the game only.
+func publicEvent(event dl99.Event) bool {
+	return event.Type != dl99.EventChatMessage
+}
+
+// serveGameStream streams the game's public events as server-sent events,
+// their ids are the game's GameSeq. A client resuming with Last-Event-ID
+// gets the events it missed, or a "reset" event if they're gone and it
+// should get the game afresh. The stream ends once stop is closed, clients
+// reconnect by themselves.
+func serveGameStream(srv eventStream, c *gin.Context, stop <-chan struct{}) {
+	gameId := c.Param("game_id")
+	if _, err := srv.GameInfo(gameId); err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+
+	lastId := c.GetHeader("Last-Event-ID")
+	if lastId == "" {
+		lastId = c.Query("last_event_id")
+	}
+	var afterSeq uint64
+	resuming := lastId != ""
+	if resuming {
+		seq, err := strconv.ParseUint(lastId, 10, 64)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		afterSeq = seq
+	}
+
+	sub, missed, resumed := srv.SubscribeGame(gameId, afterSeq, sseEventBuffer)
+	defer sub.Close()
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// a new stream starts from now, the client gets the game first
+	if !resuming {
+		missed = nil
+	} else if !resumed {
+		missed = nil
+		writeSSE(c, "", "reset", gin.H{"game_id": gameId})
+	}
+	for _, event := range missed {
+		if publicEvent(event) {
+			writeSSE(c, strconv.FormatUint(event.GameSeq, 10), event.Type, event)
+		}
+	}
+	w.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					writeSSE(c, "", "dropped", gin.H{"error": err.Error()})
+					w.Flush()
+				}
+				return
+			}
+			if !publicEvent(event) {
+				continue
+			}
+			writeSSE(c, strconv.FormatUint(event.GameSeq, 10), event.Type, event)
+			w.Flush()
+			if event.Type == dl99.EventGameReaped {
+				return
+			}
+		case <-keepAlive.C:
+			_, _ = fmt.Fprint(w, ": keep-alive\n\n")
+			w.Flush()
+		case <-c.Request.Context().Done():
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+func writeSSE(c *gin.Context, id string, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		_, _ = fmt.Fprintf(c.Writer, "id: %s\n", id)
+	}
+	_, _ = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, payload)
+}
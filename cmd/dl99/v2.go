@@ -0,0 +1,101 @@
+package main
+
+import (
+	"dl99"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"net/http"
+)
+
+// The /v2 API has one resource per path and takes JSON bodies everywhere,
+// the player acting is the player_id of the body, or of the query for
+// reads. The v1 routes stay until clients moved over.
+
+var errInvalidStateChange = errors.New("a game can only be changed to started")
+
+type v2PlayerRequest struct {
+	Name string `json:"name"`
+	Bot  bool   `json:"bot"`
+}
+
+type v2CredentialsRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type v2GameRequest struct {
+	Name string `json:"name"`
+	// required for private games, and then authenticated
+	HostId   string `json:"host_id"`
+	Private  bool   `json:"private"`
+	Password string `json:"password"`
+}
+
+// v2GameUpdate starts the game, the only change there is.
+type v2GameUpdate struct {
+	PlayerId string `json:"player_id" binding:"required"`
+	State    int    `json:"state"`
+}
+
+// v2JoinRequest joins the game as a player or as a spectator.
+type v2JoinRequest struct {
+	PlayerId   string `json:"player_id" binding:"required"`
+	InviteCode string `json:"invite_code"`
+	Password   string `json:"password"`
+}
+
+type v2MoveRequest struct {
+	PlayerId   string           `json:"player_id" binding:"required"`
+	CardIndex  *int             `json:"card_index" binding:"required"`
+	CardOption *dl99.CardOption `json:"card_option"`
+}
+
+type v2MessageRequest struct {
+	PlayerId string `json:"player_id" binding:"required"`
+	Text     string `json:"text" binding:"required"`
+}
+
+type v2InviteRequest struct {
+	// the host
+	PlayerId  string `json:"player_id" binding:"required"`
+	InviteeId string `json:"invitee_id" binding:"required"`
+}
+
+type v2HostRequest struct {
+	PlayerId string `json:"player_id" binding:"required"`
+}
+
+type v2MatchRequest struct {
+	// zero for the server's default, as is an empty RuleSet
+	TableSize int    `json:"table_size"`
+	RuleSet   string `json:"rule_set"`
+}
+
+type v2MoveList struct {
+	Moves []dl99.Move `json:"moves"`
+}
+
+// playerIdJSON is the player_id of the JSON body, which handlers can still
+// bind since the body is kept.
+func playerIdJSON(c *gin.Context) string {
+	var body struct {
+		PlayerId string `json:"player_id"`
+	}
+	_ = c.ShouldBindBodyWith(&body, binding.JSON)
+	return body.PlayerId
+}
+
+func playerIdQuery(c *gin.Context) string {
+	return c.Query("player_id")
+}
+
+// bindJSON binds the body kept by playerIdJSON, or reads it, aborting with
+// 400 if it's not valid.
+func bindJSON(c *gin.Context, v interface{}) bool {
+	if err := c.ShouldBindBodyWith(v, binding.JSON); err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
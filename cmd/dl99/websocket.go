@@ -0,0 +1,378 @@
+package main
+
+import (
+	"dl99"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	// a client that doesn't answer pings for this long is gone
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+	wsMaxMessage   = 4096
+	// events buffered per connection before it's dropped as too slow
+	wsEventBuffer = 256
+
+	// the subprotocol the server answers with, see socketToken
+	wsProtocol = "dl99"
+	// the client's other subprotocol is this and its player token
+	wsTokenProtocol = "token."
+)
+
+var errUnknownCommand = errors.New("unknown command")
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// the API carries its own tokens, not cookies, any origin may connect
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{wsProtocol},
+}
+
+// socketToken is the player token of the "token.<token>" subprotocol.
+// Browsers can't set headers on websockets, but they can ask for
+// subprotocols, which unlike the query string stay out of access logs.
+func socketToken(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, wsTokenProtocol) {
+			return strings.TrimPrefix(protocol, wsTokenProtocol)
+		}
+	}
+	return ""
+}
+
+// gameServer is what the real-time transports need from the server.
+type gameServer interface {
+	Subscribe(filter dl99.EventFilter, buffer int) *dl99.Subscription
+	SubscribeGame(gameId string, afterSeq uint64, buffer int) (*dl99.Subscription, []dl99.Event, bool)
+	Heartbeat(playerId string) error
+	GameInfo(gameId string) (dl99.GameDetail, error)
+	PlayerInfo(playerId string) (dl99.PlayerDetail, error)
+	PlayCard(gameId string, playerId string, cardIndex int, cardOption *dl99.CardOption, ifVersion *uint64) error
+	LeaveGame(gameId string, playerId string, ifVersion *uint64) error
+}
+
+// wsCommand is what a client sends.
+type wsCommand struct {
+	// "play" or "leave"
+	Type       string           `json:"type"`
+	GameId     string           `json:"game_id"`
+	CardIndex  int              `json:"card_index"`
+	CardOption *dl99.CardOption `json:"card_option"`
+}
+
+// wsMessage is what the server sends, one of Event, State or the result of
+// a command.
+type wsMessage struct {
+	// "event", "state" or "result"
+	Type  string      `json:"type"`
+	Event *dl99.Event `json:"event,omitempty"`
+
+	// the game the player is in, and the player's hand, left out if empty
+	Game *dl99.GameDetail `json:"game,omitempty"`
+	Hand []string         `json:"hand,omitempty"`
+
+	Command string `json:"command,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// the code of Error, as in the HTTP API's error bodies
+	Code string `json:"code,omitempty"`
+	// seconds until a rate limited command may be sent again
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// playerConn follows the events of the player and of the game the player is
+// in, pushing each with the game state and hand that result from it.
+type playerConn struct {
+	srv      gameServer
+	conn     *websocket.Conn
+	playerId string
+	out      chan wsMessage
+	// closed once writeLoop gave up on the connection
+	closed chan struct{}
+
+	// commands spend from the gameplay budget, like the HTTP routes
+	limiter   *rateLimiter
+	limitKeys []string
+
+	// writeLoop follows the player, readLoop plays in it
+	mu     sync.Mutex
+	gameId string
+
+	// owned by writeLoop: the player's events, the current game's, which
+	// include most of the player's, and the operators' notices
+	playerSub *dl99.Subscription
+	gameSub   *dl99.Subscription
+	noticeSub *dl99.Subscription
+}
+
+// serveWebSocket upgrades the request, the player is authenticated already.
+// Every command spends from limiter.
+func serveWebSocket(srv gameServer, limiter *rateLimiter, c *gin.Context, playerId string) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("websocket upgrade failed: %v", err)
+		return
+	}
+
+	player, err := srv.PlayerInfo(playerId)
+	if err != nil {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+		_ = conn.Close()
+		return
+	}
+
+	pc := &playerConn{
+		srv:      srv,
+		conn:     conn,
+		playerId: playerId,
+		gameId:   player.GameId,
+		out:      make(chan wsMessage, 16),
+		closed:   make(chan struct{}),
+
+		limiter:   limiter,
+		limitKeys: limitKeys(c, playerId),
+	}
+	// before the first state is sent, so nothing falls in between
+	pc.playerSub = srv.Subscribe(dl99.EventFilter{PlayerId: playerId}, wsEventBuffer)
+	pc.noticeSub = srv.Subscribe(dl99.EventFilter{Types: []string{dl99.EventMaintenance}}, wsEventBuffer)
+	if pc.gameId != "" {
+		pc.gameSub = srv.Subscribe(dl99.EventFilter{GameId: pc.gameId}, wsEventBuffer)
+	}
+	done := make(chan struct{})
+	go pc.writeLoop(done)
+	pc.readLoop()
+
+	close(done)
+}
+
+// readLoop runs the commands until the connection breaks.
+func (pc *playerConn) readLoop() {
+	pc.conn.SetReadLimit(wsMaxMessage)
+	_ = pc.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	pc.conn.SetPongHandler(func(string) error {
+		_ = pc.srv.Heartbeat(pc.playerId)
+		return pc.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var command wsCommand
+		if err := pc.conn.ReadJSON(&command); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				if !pc.send(wsMessage{Type: "result", Error: "invalid command: " + err.Error()}) {
+					return
+				}
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket of player [%s] read failed: %v", pc.playerId, err)
+			}
+			return
+		}
+		_ = pc.srv.Heartbeat(pc.playerId)
+
+		result := wsMessage{Type: "result", Command: command.Type}
+		if ok, wait := pc.limiter.take(pc.limitKeys, time.Now()); !ok {
+			result.Error = errTooManyRequests.Error()
+			_, result.Code = errorCode(http.StatusTooManyRequests, errTooManyRequests)
+			result.RetryAfter = retryAfter(wait)
+		} else if err := pc.run(command); err != nil && err != dl99.ErrWin && err != dl99.ErrLose {
+			result.Error = err.Error()
+			_, result.Code = errorCode(http.StatusInternalServerError, err)
+		}
+		if !pc.send(result) {
+			return
+		}
+	}
+}
+
+// send hands the message to writeLoop, false if the connection is gone.
+func (pc *playerConn) send(message wsMessage) bool {
+	select {
+	case pc.out <- message:
+		return true
+	case <-pc.closed:
+		return false
+	}
+}
+
+func (pc *playerConn) run(command wsCommand) error {
+	gameId := command.GameId
+	if gameId == "" {
+		gameId = pc.game()
+	}
+	switch command.Type {
+	case "play":
+		cardOption := command.CardOption
+		if cardOption == nil {
+			cardOption = &dl99.CardOption{}
+		}
+		return pc.srv.PlayCard(gameId, pc.playerId, command.CardIndex, cardOption, nil)
+	case "leave":
+		return pc.srv.LeaveGame(gameId, pc.playerId, nil)
+	default:
+		return errUnknownCommand
+	}
+}
+
+// writeLoop is the only writer of the connection, as gorilla requires.
+func (pc *playerConn) writeLoop(done <-chan struct{}) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	defer close(pc.closed)
+	defer pc.conn.Close()
+	defer func() {
+		pc.playerSub.Close()
+		pc.noticeSub.Close()
+		if pc.gameSub != nil {
+			pc.gameSub.Close()
+		}
+	}()
+
+	if pc.game() != "" {
+		if !pc.write(pc.state()) {
+			return
+		}
+	}
+
+	for {
+		// nil without a game, never ready
+		var gameEvents <-chan dl99.Event
+		if pc.gameSub != nil {
+			gameEvents = pc.gameSub.C
+		}
+
+		select {
+		case event, ok := <-pc.playerSub.C:
+			if !ok {
+				pc.dropped(pc.playerSub)
+				return
+			}
+			// the game's subscription has it too
+			if event.GameId != "" && event.GameId == pc.game() {
+				continue
+			}
+			if !pc.writeEvent(event) {
+				return
+			}
+			switch event.Type {
+			case dl99.EventPlayerJoined, dl99.EventSpectatorJoined:
+				if !pc.follow(event) {
+					return
+				}
+			}
+		case event, ok := <-gameEvents:
+			if !ok {
+				pc.dropped(pc.gameSub)
+				return
+			}
+			if !pc.writeEvent(event) {
+				return
+			}
+		case event, ok := <-pc.noticeSub.C:
+			if !ok {
+				pc.dropped(pc.noticeSub)
+				return
+			}
+			if !pc.writeEvent(event) {
+				return
+			}
+		case message := <-pc.out:
+			if !pc.write(message) {
+				return
+			}
+		case <-ping.C:
+			if err := pc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// follow moves the game subscription to the game the player just joined,
+// or watches, sending what happened there since joined.
+func (pc *playerConn) follow(joined dl99.Event) bool {
+	if pc.gameSub != nil {
+		// published before joined, so they're all buffered already
+		for len(pc.gameSub.C) > 0 {
+			if event, ok := <-pc.gameSub.C; ok && !pc.writeEvent(event) {
+				return false
+			}
+		}
+		pc.gameSub.Close()
+	}
+
+	pc.mu.Lock()
+	pc.gameId = joined.GameId
+	pc.mu.Unlock()
+
+	sub, missed, _ := pc.srv.SubscribeGame(joined.GameId, joined.GameSeq, wsEventBuffer)
+	pc.gameSub = sub
+	for _, event := range missed {
+		if !pc.writeEvent(event) {
+			return false
+		}
+	}
+	return pc.write(pc.state())
+}
+
+// writeEvent sends the event, followed by the game state if it is about
+// the player's game.
+func (pc *playerConn) writeEvent(event dl99.Event) bool {
+	if !pc.write(wsMessage{Type: "event", Event: &event}) {
+		return false
+	}
+	if event.GameId != "" && event.GameId == pc.game() {
+		return pc.write(pc.state())
+	}
+	return true
+}
+
+// dropped tells the client why its closed subscription is gone, if it was
+// dropped for being too slow.
+func (pc *playerConn) dropped(sub *dl99.Subscription) {
+	if err := sub.Err(); err != nil {
+		_ = pc.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+			time.Now().Add(wsWriteTimeout))
+	}
+}
+
+func (pc *playerConn) game() string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.gameId
+}
+
+// state is the game as the player sees it now, with the player's hand.
+func (pc *playerConn) state() wsMessage {
+	message := wsMessage{Type: "state", Hand: []string{}}
+	if game, err := pc.srv.GameInfo(pc.game()); err == nil {
+		message.Game = &game
+	}
+	if player, err := pc.srv.PlayerInfo(pc.playerId); err == nil {
+		message.Hand = player.HandCards
+	}
+	return message
+}
+
+func (pc *playerConn) write(message wsMessage) bool {
+	_ = pc.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := pc.conn.WriteJSON(message); err != nil {
+		log.Printf("websocket of player [%s] write failed: %v", pc.playerId, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,311 @@
+package dl99
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSubscriberDropped = errors.New("subscriber dropped, it fell behind")
+)
+
+const (
+	EventPlayerCreated      = "player_created"
+	EventGameCreated        = "game_created"
+	EventPlayerJoined       = "player_joined"
+	EventPlayerLeft         = "player_left"
+	EventGameStarted        = "game_started"
+	EventCardPlayed         = "card_played"
+	EventTurnSkipped        = "turn_skipped"
+	EventGameFinished       = "game_finished"
+	EventGameReaped         = "game_reaped"
+	EventChatMessage        = "chat_message"
+	EventSpectatorJoined    = "spectator_joined"
+	EventSpectatorLeft      = "spectator_left"
+	EventPlayerDisconnected = "player_disconnected"
+	EventPlayerReconnected  = "player_reconnected"
+)
+
+const (
+	defaultSubscriberBuffer = 64
+	maxSubscriberBuffer     = 4096
+
+	// events kept per game to resume from, see SubscribeGame
+	maxGameHistory = 256
+)
+
+// Event is something that happened to a game or a player. Seq increases by
+// one for every event published by the server, GameSeq for every event of
+// the game. Both start over when the server restarts.
+type Event struct {
+	Seq      uint64    `json:"seq"`
+	GameSeq  uint64    `json:"game_seq,omitempty"`
+	Type     string    `json:"type"`
+	GameId   string    `json:"game_id,omitempty"`
+	PlayerId string    `json:"player_id,omitempty"`
+	At       time.Time `json:"at"`
+	// depends on Type, e.g. a Move for EventCardPlayed
+	Data interface{} `json:"data,omitempty"`
+}
+
+// EventFilter picks the events a subscriber gets, zero values don't filter.
+type EventFilter struct {
+	GameId   string
+	PlayerId string
+	Types    []string
+}
+
+func (filter EventFilter) match(event Event) bool {
+	if filter.GameId != "" && filter.GameId != event.GameId {
+		return false
+	}
+	if filter.PlayerId != "" && filter.PlayerId != event.PlayerId {
+		return false
+	}
+	if len(filter.Types) == 0 {
+		return true
+	}
+	for _, t := range filter.Types {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events matching its filter on C. A subscriber
+// that lets C fill up is dropped: C gets closed and Err tells why.
+type Subscription struct {
+	C <-chan Event
+
+	id     uint64
+	filter EventFilter
+	ch     chan Event
+	bus    *eventBus
+	err    error
+}
+
+// Err is ErrSubscriberDropped once the subscription was dropped for being
+// too slow, nil otherwise.
+func (sub *Subscription) Err() error {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+
+	return sub.err
+}
+
+// Close unsubscribes, C gets closed.
+func (sub *Subscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+
+	sub.bus.remove(sub, nil)
+}
+
+// eventBus has its own lock, so subscribing doesn't wait for the server and
+// publishing never blocks on subscribers.
+type eventBus struct {
+	mu     sync.Mutex
+	seq    uint64
+	nextId uint64
+	subs   map[uint64]*Subscription
+	// subscriptions filtered by game, or else by player, or else by type,
+	// so an event only goes through the filters that may match it
+	byGame   map[string]map[uint64]*Subscription
+	byPlayer map[string]map[uint64]*Subscription
+	byType   map[string]map[uint64]*Subscription
+	// the others, matched against every event
+	unindexed map[uint64]*Subscription
+
+	// game id -> last GameSeq, and the latest events of the game
+	gameSeq map[string]uint64
+	history map[string][]Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs:      make(map[uint64]*Subscription),
+		byGame:    make(map[string]map[uint64]*Subscription),
+		byPlayer:  make(map[string]map[uint64]*Subscription),
+		byType:    make(map[string]map[uint64]*Subscription),
+		unindexed: make(map[uint64]*Subscription),
+		gameSeq:   make(map[string]uint64),
+		history:   make(map[string][]Event),
+	}
+}
+
+func (bus *eventBus) subscribe(filter EventFilter, buffer int) *Subscription {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	return bus.add(filter, buffer)
+}
+
+// add must be called with bus.mu held.
+func (bus *eventBus) add(filter EventFilter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultSubscriberBuffer
+	}
+	if buffer > maxSubscriberBuffer {
+		buffer = maxSubscriberBuffer
+	}
+
+	bus.nextId++
+	ch := make(chan Event, buffer)
+	sub := &Subscription{
+		C:      ch,
+		id:     bus.nextId,
+		filter: filter,
+		ch:     ch,
+		bus:    bus,
+	}
+	bus.subs[sub.id] = sub
+	index, keys := bus.index(filter)
+	if index == nil {
+		bus.unindexed[sub.id] = sub
+	}
+	for _, key := range keys {
+		if index[key] == nil {
+			index[key] = make(map[uint64]*Subscription)
+		}
+		index[key][sub.id] = sub
+	}
+	return sub
+}
+
+// index is where subscriptions with filter are indexed, under keys, nil for
+// unindexed ones.
+func (bus *eventBus) index(filter EventFilter) (map[string]map[uint64]*Subscription, []string) {
+	switch {
+	case filter.GameId != "":
+		return bus.byGame, []string{filter.GameId}
+	case filter.PlayerId != "":
+		return bus.byPlayer, []string{filter.PlayerId}
+	case len(filter.Types) > 0:
+		return bus.byType, filter.Types
+	}
+	return nil, nil
+}
+
+// remove must be called with bus.mu held.
+func (bus *eventBus) remove(sub *Subscription, err error) {
+	if _, ok := bus.subs[sub.id]; !ok {
+		return
+	}
+	delete(bus.subs, sub.id)
+	index, keys := bus.index(sub.filter)
+	if index == nil {
+		delete(bus.unindexed, sub.id)
+	}
+	for _, key := range keys {
+		delete(index[key], sub.id)
+		if len(index[key]) == 0 {
+			delete(index, key)
+		}
+	}
+	sub.err = err
+	close(sub.ch)
+}
+
+func (bus *eventBus) publish(event Event) Event {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	bus.seq++
+	event.Seq = bus.seq
+	if event.GameId != "" {
+		bus.gameSeq[event.GameId]++
+		event.GameSeq = bus.gameSeq[event.GameId]
+		history := append(bus.history[event.GameId], event)
+		if len(history) > maxGameHistory {
+			history = history[len(history)-maxGameHistory:]
+		}
+		bus.history[event.GameId] = history
+	}
+	// nothing happens to a reaped game anymore
+	if event.Type == EventGameReaped {
+		delete(bus.gameSeq, event.GameId)
+		delete(bus.history, event.GameId)
+	}
+	bus.deliver(bus.unindexed, event)
+	if event.GameId != "" {
+		bus.deliver(bus.byGame[event.GameId], event)
+	}
+	if event.PlayerId != "" {
+		bus.deliver(bus.byPlayer[event.PlayerId], event)
+	}
+	bus.deliver(bus.byType[event.Type], event)
+	return event
+}
+
+func (bus *eventBus) deliver(subs map[uint64]*Subscription, event Event) {
+	for _, sub := range subs {
+		if !sub.filter.match(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			log.Printf("event subscriber %d dropped at seq %d", sub.id, event.Seq)
+			bus.remove(sub, ErrSubscriberDropped)
+		}
+	}
+}
+
+// close ends every subscription, their C gets closed.
+func (bus *eventBus) close() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for _, sub := range bus.subs {
+		bus.remove(sub, nil)
+	}
+}
+
+// Subscribe returns a subscription to the events matching filter, buffering
+// up to buffer events, zero or less picks a default. Close it when done.
+func (srv *server) Subscribe(filter EventFilter, buffer int) *Subscription {
+	return srv.events.subscribe(filter, buffer)
+}
+
+// SubscribeGame subscribes to the game's events and returns the ones after
+// GameSeq afterSeq it missed, with no gap in between. resumed is false when
+// those events aren't kept anymore, or never were, the subscriber should
+// then get the game state afresh.
+func (srv *server) SubscribeGame(gameId string, afterSeq uint64, buffer int) (sub *Subscription, missed []Event, resumed bool) {
+	bus := srv.events
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	sub = bus.add(EventFilter{GameId: gameId}, buffer)
+	missed = make([]Event, 0)
+	history := bus.history[gameId]
+	last := bus.gameSeq[gameId]
+	if afterSeq > last {
+		return sub, missed, false
+	}
+	if afterSeq == last {
+		return sub, missed, true
+	}
+	if len(history) == 0 || history[0].GameSeq > afterSeq+1 {
+		return sub, missed, false
+	}
+	for _, event := range history {
+		if event.GameSeq > afterSeq {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, true
+}
+
+func (srv *server) publish(eventType string, gameId string, playerId string, data interface{}) {
+	srv.events.publish(Event{
+		Type:     eventType,
+		GameId:   gameId,
+		PlayerId: playerId,
+		At:       time.Now(),
+		Data:     data,
+	})
+}
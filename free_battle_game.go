@@ -44,36 +44,74 @@ type freeBattleGame struct {
 	score        int
 	nextPlayerId string
 	state        int
+	source       *countingSource
 	rng          *rand.Rand
 
 	deck     []Card
 	deadwood []Card
 
+	// ids of the players dealt in when the game started
+	participants []string
+	// ids in the order they were out, the winner last
+	standings []string
+	// player id -> what the player did in this game
+	tallies map[string]*gameTally
+
+	spectators []string
+	chat       *chatLog
+
+	moves     []Move
+	startedAt time.Time
+	// last time a player did something in the game, see cleanUpGames
+	activeAt time.Time
+	// by an operator, see PauseGame
+	paused bool
+
+	// bumped by every change to the game, see touch and WaitGame
+	version uint64
+	// closed by the next touch, nil if nobody waits
+	changed chan struct{}
+
+	// host is optional for public games
+	hostId       string
+	private      bool
+	inviteCode   string
+	passwordHash []byte
+	// ids of invited players who neither joined nor declined yet
+	invitations []string
+
 	// if Players order is clockwise, then CurrentPlayerIndex will add by 1
 	// if Players order is counterclockwise, then CurrentPlayerIndex will sub by 1
 	clockwise bool
 }
 
-func newGame(name string) *freeBattleGame {
+func newGame(id string, name string, seed int64) *freeBattleGame {
 	if name == "" {
 		name = defaultGameName
 	}
+	source := newCountingSource(seed, 0)
 	game := &freeBattleGame{
 		mu:        &sync.Mutex{},
-		id:        randomId(gamePrefix),
+		id:        id,
 		name:      name,
 		players:   make([]*player, 0, minPlayers),
 		state:     GameCreated,
-		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		source:    source,
+		rng:       rand.New(source),
 		clockwise: true,
+		chat:      newChatLog(),
 	}
 	return game
 }
 
-func (game *freeBattleGame) join(player *player) error {
+func (game *freeBattleGame) join(player *player, at time.Time) error {
 	game.mu.Lock()
 	defer game.mu.Unlock()
 
+	if game.paused {
+		return ErrGamePaused
+	}
+
 	if game.state != GameCreated {
 		return ErrInvalidGameState
 	}
@@ -81,16 +119,20 @@ func (game *freeBattleGame) join(player *player) error {
 	if player.inGame() {
 		return ErrPlayerAlreadyJoined
 	}
+	defer game.touch()
 
 	player.gameId = game.id
 	player.hand = nil
 	game.players = append(game.players, player)
+	game.uninvite(player.id)
+	game.chatLog().admit(player.id)
+	game.systemMessage(at, "%s joined", player.name)
 	log.Printf("game [%s] player [%s] joined", game.name, player.name)
 
 	return nil
 }
 
-func (game *freeBattleGame) leave(player *player, inGame bool) error {
+func (game *freeBattleGame) leave(player *player, inGame bool, at time.Time) error {
 	// 当 inGame 为真时，leave() 方法是在 play() 内部调用的。
 	// 已经持有 game 对象内部的锁了，就不需要再持有了。
 	// 当 inGame 为假时，leave() 方法是在 API 请求里调用的。
@@ -107,6 +149,7 @@ func (game *freeBattleGame) leave(player *player, inGame bool) error {
 	playerCount := len(game.players)
 	for i := 0; i < playerCount; i++ {
 		if game.players[i].id == player.id {
+			game.touch()
 			if game.state == GameStarted {
 				// 如果当前离开的玩家就是下一位该出牌的玩家
 				// 就要再计算一次下一位出牌玩家
@@ -122,20 +165,23 @@ func (game *freeBattleGame) leave(player *player, inGame bool) error {
 				// 离开的玩家的手牌，都要丢进弃牌堆
 				game.deadwood = append(game.deadwood, player.hand...)
 				player.hand = nil
-
-				// 最后离开的玩家获胜了
-				if len(game.players) < 1 {
-					game.state = GameFinished
-					return ErrWin
-				}
 			}
 
 			game.players = append(game.players[:i], game.players[i+1:]...)
 			player.gameId = ""
 			log.Printf("game [%s] player [%s] left, now we have %d players remained",
 				game.name, player.name, len(game.players))
+			if !inGame {
+				game.systemMessage(at, "%s left", player.name)
+			}
 
 			if game.state == GameStarted {
+				game.standings = append(game.standings, player.id)
+
+				// 最后剩下的玩家获胜了
+				if len(game.players) == 1 {
+					game.finish(at)
+				}
 				return ErrLose
 			}
 
@@ -150,6 +196,10 @@ func (game *freeBattleGame) startGame() error {
 	game.mu.Lock()
 	defer game.mu.Unlock()
 
+	if game.paused {
+		return ErrGamePaused
+	}
+
 	if game.state != GameCreated {
 		return ErrInvalidGameState
 	}
@@ -158,13 +208,14 @@ func (game *freeBattleGame) startGame() error {
 	if playerCount < minPlayers {
 		return ErrInSufficientPlayers
 	}
+	defer game.touch()
 
 	setsOfCards := (playerCount + 1) / 2
 	game.deck = make([]Card, 0, len(freeBattleDeadline99Deck)*setsOfCards)
 	for i := 0; i < setsOfCards; i++ {
 		game.deck = append(game.deck, freeBattleDeadline99Deck...)
 	}
-	shuffle(game.deck)
+	shuffle(game.rng, game.deck)
 
 	game.deadwood = make([]Card, 0, len(game.deck))
 
@@ -174,6 +225,14 @@ func (game *freeBattleGame) startGame() error {
 		}
 	}
 
+	game.participants = make([]string, 0, playerCount)
+	game.standings = make([]string, 0, playerCount)
+	game.tallies = make(map[string]*gameTally, playerCount)
+	for _, player := range game.players {
+		game.participants = append(game.participants, player.id)
+		game.tallies[player.id] = newGameTally()
+	}
+
 	game.nextPlayerId = game.players[0].id
 	game.state = GameStarted
 	log.Printf("game [%s] started", game.name)
@@ -181,10 +240,14 @@ func (game *freeBattleGame) startGame() error {
 	return nil
 }
 
-func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardOption *CardOption) error {
+func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardOption *CardOption, at time.Time) error {
 	game.mu.Lock()
 	defer game.mu.Unlock()
 
+	if game.paused {
+		return ErrGamePaused
+	}
+
 	if game.state != GameStarted {
 		return ErrInvalidGameState
 	}
@@ -195,7 +258,9 @@ func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardO
 
 	// 当前玩家出牌前，就被别人把手牌取光了
 	if len(currentPlayer.hand) == 0 {
-		if err := game.leave(currentPlayer, true); err != nil {
+		defer game.touch()
+		game.systemMessage(at, "%s has no cards left and is out", currentPlayer.name)
+		if err := game.leave(currentPlayer, true, at); err != nil {
 			log.Printf("game [%s] player [%s] leave failed: %v", game.name, currentPlayer.name, err)
 			return err
 		}
@@ -203,81 +268,88 @@ func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardO
 		return ErrLose
 	}
 
-	var card Card
-	if 0 <= handCardIndex && handCardIndex < len(currentPlayer.hand) {
-		card = currentPlayer.hand[handCardIndex]
-		currentPlayer.hand = append(currentPlayer.hand[:handCardIndex], currentPlayer.hand[handCardIndex+1:]...)
-		game.deadwood = append(game.deadwood, card)
-		log.Printf("game [%s] player [%s] play card [%s]", game.name, currentPlayer.name, card.Name())
-	} else {
+	if handCardIndex < 0 || handCardIndex >= len(currentPlayer.hand) {
 		return ErrInvalidHandCard
 	}
+	card := currentPlayer.hand[handCardIndex]
+	// refused before the card leaves the hand, so the player can try again
+	if cardOption == nil && needsCardOption(card.Rank()) {
+		return ErrInvalidCardOption
+	}
+
+	defer game.touch()
+	game.tally(currentPlayer).played(card, game.score)
+	currentPlayer.hand = append(currentPlayer.hand[:handCardIndex], currentPlayer.hand[handCardIndex+1:]...)
+	game.deadwood = append(game.deadwood, card)
+	log.Printf("game [%s] player [%s] play card [%s]", game.name, currentPlayer.name, card.Name())
 
 	// Game logic
 	tempScore := game.score
 	skipDraw := false
 	skipNextPosition := false
+	move := Move{
+		PlayerId: currentPlayer.id,
+		Card:     card.Name(),
+	}
 	switch card.Rank() {
 	case Rank10:
-		if cardOption == nil {
-			return ErrInvalidCardOption
-		}
 		if cardOption.Rank10Add {
 			tempScore += 10
+			move.Effect = EffectAdd
 		} else {
 			tempScore -= 10
+			move.Effect = EffectSubtract
 		}
 	case RankQueen:
-		if cardOption == nil {
-			return ErrInvalidCardOption
-		}
 		if cardOption.RankQueenAdd {
 			tempScore += 20
+			move.Effect = EffectAdd
 		} else {
 			tempScore -= 20
+			move.Effect = EffectSubtract
 		}
 	case RankKing:
 		tempScore = deadlineScore
+		move.Effect = EffectDeadline
 	case RankAce:
-		if cardOption == nil {
-			return ErrInvalidCardOption
-		}
+		move.Effect = EffectNextPlayer
 		for _, p := range game.players {
 			if p.id == cardOption.RankAceChangeNextPlayer {
 				game.nextPlayerId = cardOption.RankAceChangeNextPlayer
 				skipNextPosition = true
+				move.Target = p.id
 				break
 			}
 		}
 	case Rank8:
 		game.clockwise = !game.clockwise
+		move.Effect = EffectReverse
 	case RankJack:
-		if cardOption == nil {
-			return ErrInvalidCardOption
-		}
+		move.Effect = EffectSteal
 		for _, p := range game.players {
 			if p.id == cardOption.RankJackDrawOneCardFromPlayer {
 				cardIndex := game.rng.Intn(len(p.hand))
 				drewCard := p.hand[cardIndex]
 				p.hand = append(p.hand[:cardIndex], p.hand[cardIndex+1:]...)
 				currentPlayer.hand = append(currentPlayer.hand, drewCard)
+				move.Target = p.id
 				break
 			}
 		}
 		skipDraw = true
 	case Rank7:
-		if cardOption == nil {
-			return ErrInvalidCardOption
-		}
+		move.Effect = EffectSwap
 		for _, p := range game.players {
 			if p.id == cardOption.Rank7ChangeAllHandToPlayer {
 				currentPlayer.hand, p.hand = p.hand, currentPlayer.hand
+				move.Target = p.id
 				break
 			}
 		}
 		skipDraw = true
 	case Rank3, Rank4, Rank5, Rank6, Rank9:
 		tempScore += card.Score()
+		move.Effect = EffectAdd
 	default:
 		return ErrInvalidRank
 	}
@@ -286,8 +358,16 @@ func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardO
 		tempScore = 0
 	}
 
+	move.Seq = len(game.moves) + 1
+	move.Score = tempScore
+	move.Busted = tempScore > deadlineScore
+	game.moves = append(game.moves, move)
+
 	if tempScore > deadlineScore {
-		if err := game.leave(currentPlayer, true); err != nil {
+		game.tally(currentPlayer).BustRank = card.Rank()
+		game.systemMessage(at, "%s busted playing %s, the score would have been %d",
+			currentPlayer.name, card.Name(), tempScore)
+		if err := game.leave(currentPlayer, true, at); err != nil {
 			log.Printf("game [%s] player [%s] leave failed: %v", game.name, currentPlayer.name, err)
 			return err
 		}
@@ -299,12 +379,7 @@ func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardO
 	}
 
 	if len(game.players) == 1 {
-		if err := game.leave(currentPlayer, true); err != nil {
-			log.Printf("game [%s] player [%s] leave failed: %v", game.name, currentPlayer.name, err)
-			return err
-		}
-		game.state = GameFinished
-		log.Printf("player [%s] won in game [%s]", currentPlayer.name, game.name)
+		game.finish(at)
 		return ErrWin
 	}
 
@@ -317,18 +392,7 @@ func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardO
 	}
 
 	if !skipNextPosition {
-		playerCount := len(game.players)
-		for i := 0; i < len(game.players); i++ {
-			if game.players[i].id == currentPlayer.id {
-				if game.clockwise {
-					game.nextPlayerId = game.players[(i+1)%playerCount].id
-				} else {
-					game.nextPlayerId = game.players[(i+playerCount-1)%playerCount].id
-				}
-				break
-			}
-		}
-		log.Printf("game [%s] next player will be [%s]", game.name, game.nextPlayerId)
+		game.passTurn(currentPlayer)
 	} else {
 		log.Printf("game [%s] will not change next player for now", game.name)
 	}
@@ -336,12 +400,119 @@ func (game *freeBattleGame) play(currentPlayer *player, handCardIndex int, cardO
 	return nil
 }
 
+// needsCardOption tells whether playing a card of the rank takes a
+// CardOption.
+func needsCardOption(rank Rank) bool {
+	switch rank {
+	case Rank10, RankQueen, RankAce, RankJack, Rank7:
+		return true
+	}
+	return false
+}
+
+// passTurn makes the player after currentPlayer, in the current direction,
+// the next player.
+func (game *freeBattleGame) passTurn(currentPlayer *player) {
+	playerCount := len(game.players)
+	for i := 0; i < len(game.players); i++ {
+		if game.players[i].id == currentPlayer.id {
+			if game.clockwise {
+				game.nextPlayerId = game.players[(i+1)%playerCount].id
+			} else {
+				game.nextPlayerId = game.players[(i+playerCount-1)%playerCount].id
+			}
+			break
+		}
+	}
+	log.Printf("game [%s] next player will be [%s]", game.name, game.nextPlayerId)
+}
+
+// skipTurn passes the current player's turn without playing or drawing.
+func (game *freeBattleGame) skipTurn(currentPlayer *player, at time.Time) error {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if game.paused {
+		return ErrGamePaused
+	}
+	if game.state != GameStarted {
+		return ErrInvalidGameState
+	}
+	if game.nextPlayerId != currentPlayer.id {
+		return ErrYouAreNotCurrentPlayer
+	}
+	game.systemMessage(at, "%s is disconnected, skipping the turn", currentPlayer.name)
+	game.passTurn(currentPlayer)
+	game.touch()
+	return nil
+}
+
+// touch bumps the version and wakes up whoever waits for it to change. It
+// is called with the server locked, and the game too when in a method of
+// the game.
+func (game *freeBattleGame) touch() {
+	game.version++
+	if game.changed != nil {
+		close(game.changed)
+		game.changed = nil
+	}
+}
+
+// watch returns a channel closed once the version changes, it's called
+// with the server read-locked, so possibly by many at once.
+func (game *freeBattleGame) watch() <-chan struct{} {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if game.changed == nil {
+		game.changed = make(chan struct{})
+	}
+	return game.changed
+}
+
+// finish ends the game, the players still in it win.
+func (game *freeBattleGame) finish(at time.Time) {
+	for _, winner := range game.players {
+		game.deadwood = append(game.deadwood, winner.hand...)
+		winner.hand = nil
+		winner.gameId = ""
+		game.standings = append(game.standings, winner.id)
+		game.systemMessage(at, "%s won", winner.name)
+		log.Printf("player [%s] won in game [%s]", winner.name, game.name)
+	}
+	game.players = game.players[:0]
+	game.nextPlayerId = ""
+	game.state = GameFinished
+}
+
+// placement of a participant in a finished game, 1 is the winner.
+func (game *freeBattleGame) placement(playerId string) int {
+	for i, id := range game.standings {
+		if id == playerId {
+			return len(game.standings) - i
+		}
+	}
+	return 0
+}
+
+func (game *freeBattleGame) tally(player *player) *gameTally {
+	if game.tallies == nil {
+		game.tallies = make(map[string]*gameTally)
+	}
+	tally, ok := game.tallies[player.id]
+	if !ok {
+		tally = newGameTally()
+		game.tallies[player.id] = tally
+	}
+	return tally
+}
+
 func (game *freeBattleGame) recycle() {
 	if len(game.deck) > 0 {
 		game.deadwood = append(game.deadwood, game.deck...)
 		game.deck = game.deck[:0]
 	}
-	shuffle(game.deadwood)
+	shuffle(game.rng, game.deadwood)
 	game.deck, game.deadwood = game.deadwood, game.deck
 }
 
@@ -0,0 +1,234 @@
+package dl99
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrInvalidLeaderboardMetric = errors.New("invalid leaderboard metric")
+	ErrInvalidLeaderboardWindow = errors.New("invalid leaderboard window")
+)
+
+const (
+	MetricRating  = "rating"
+	MetricWins    = "wins"
+	MetricWinRate = "win_rate"
+
+	WindowAllTime = "all"
+	WindowWeekly  = "week"
+
+	defaultLeaderboardLimit = 20
+	maxLeaderboardLimit     = 100
+
+	// players need this many games in the window to be ranked by win rate
+	defaultWinRateMinGames = 10
+)
+
+type LeaderboardQuery struct {
+	Metric string `form:"metric"`
+	Window string `form:"window"`
+
+	// only used by MetricWinRate
+	MinGames int `form:"min_games"`
+
+	Offset int `form:"offset"`
+	Limit  int `form:"limit"`
+}
+
+type LeaderboardEntry struct {
+	Rank     int     `json:"rank"`
+	PlayerId string  `json:"player_id"`
+	Name     string  `json:"name"`
+	Games    int     `json:"games"`
+	Wins     int     `json:"wins"`
+	WinRate  float64 `json:"win_rate"`
+	Rating   float64 `json:"rating"`
+}
+
+type Leaderboard struct {
+	Metric  string             `json:"metric"`
+	Window  string             `json:"window"`
+	Total   int                `json:"total"`
+	Offset  int                `json:"offset"`
+	Limit   int                `json:"limit"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// leaderboardTally is a player's line before ranking.
+type leaderboardTally struct {
+	LeaderboardEntry
+	// whether Rating comes from a rated game
+	rated bool
+}
+
+// playerTallies are the players' lifetime stats and ratings, which outlive
+// the archives. Bots are never ranked.
+func playerTallies(players []*player) []*leaderboardTally {
+	tallies := make([]*leaderboardTally, 0, len(players))
+	for _, player := range players {
+		if player.bot || player.stats.GamesPlayed == 0 {
+			continue
+		}
+		tallies = append(tallies, &leaderboardTally{
+			LeaderboardEntry: LeaderboardEntry{
+				PlayerId: player.id,
+				Name:     player.name,
+				Games:    player.stats.GamesPlayed,
+				Wins:     player.stats.Wins,
+				Rating:   player.rating,
+			},
+			rated: len(player.ratingHistory) > 0,
+		})
+	}
+	return tallies
+}
+
+// archiveTallies count the archived games finished since since. Bots are
+// never ranked. A player's rating is the one after their latest rated game
+// in the window.
+func archiveTallies(archives []*GameArchive, since time.Time) []*leaderboardTally {
+	type tally struct {
+		leaderboardTally
+		namedAt time.Time
+		ratedAt time.Time
+	}
+
+	tallies := make(map[string]*tally)
+	for _, archive := range archives {
+		if archive.FinishedAt.Before(since) {
+			continue
+		}
+		for _, p := range archive.Participants {
+			if p.Bot {
+				continue
+			}
+			t, ok := tallies[p.Id]
+			if !ok {
+				t = &tally{}
+				t.PlayerId = p.Id
+				tallies[p.Id] = t
+			}
+			t.Games++
+			if p.Placement == 1 {
+				t.Wins++
+			}
+			if !archive.FinishedAt.Before(t.namedAt) {
+				t.Name = p.Name
+				t.namedAt = archive.FinishedAt
+			}
+			if archive.Rated && !archive.FinishedAt.Before(t.ratedAt) {
+				t.Rating = p.Rating
+				t.ratedAt = archive.FinishedAt
+				t.rated = true
+			}
+		}
+	}
+
+	result := make([]*leaderboardTally, 0, len(tallies))
+	for _, t := range tallies {
+		result = append(result, &t.leaderboardTally)
+	}
+	return result
+}
+
+// rankLeaderboard ranks the tallies by the query's metric, players never
+// rated are left out of MetricRating.
+func rankLeaderboard(tallies []*leaderboardTally, query LeaderboardQuery) Leaderboard {
+	entries := make([]LeaderboardEntry, 0, len(tallies))
+	for _, t := range tallies {
+		t.WinRate = float64(t.Wins) / float64(t.Games)
+		switch query.Metric {
+		case MetricRating:
+			if !t.rated {
+				continue
+			}
+		case MetricWinRate:
+			if t.Games < query.MinGames {
+				continue
+			}
+		}
+		entries = append(entries, t.LeaderboardEntry)
+	}
+
+	key := func(e LeaderboardEntry) float64 {
+		switch query.Metric {
+		case MetricWins:
+			return float64(e.Wins)
+		case MetricWinRate:
+			return e.WinRate
+		default:
+			return e.Rating
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		ki, kj := key(entries[i]), key(entries[j])
+		if ki != kj {
+			return ki > kj
+		}
+		if entries[i].Games != entries[j].Games {
+			return entries[i].Games > entries[j].Games
+		}
+		return entries[i].PlayerId < entries[j].PlayerId
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+
+	board := Leaderboard{
+		Metric: query.Metric,
+		Window: query.Window,
+		Total:  len(entries),
+		Offset: query.Offset,
+		Limit:  query.Limit,
+	}
+	if query.Offset < len(entries) {
+		end := query.Offset + query.Limit
+		if end > len(entries) {
+			end = len(entries)
+		}
+		board.Entries = entries[query.Offset:end]
+	} else {
+		board.Entries = []LeaderboardEntry{}
+	}
+	return board
+}
+
+// normalize fills in defaults and checks the query, returning the start of
+// its time window.
+func (query *LeaderboardQuery) normalize(now time.Time) (time.Time, error) {
+	if query.Metric == "" {
+		query.Metric = MetricRating
+	}
+	switch query.Metric {
+	case MetricRating, MetricWins, MetricWinRate:
+	default:
+		return time.Time{}, ErrInvalidLeaderboardMetric
+	}
+
+	if query.MinGames <= 0 {
+		query.MinGames = defaultWinRateMinGames
+	}
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultLeaderboardLimit
+	}
+	if query.Limit > maxLeaderboardLimit {
+		query.Limit = maxLeaderboardLimit
+	}
+
+	if query.Window == "" {
+		query.Window = WindowAllTime
+	}
+	switch query.Window {
+	case WindowAllTime:
+		return time.Time{}, nil
+	case WindowWeekly:
+		return now.AddDate(0, 0, -7), nil
+	default:
+		return time.Time{}, ErrInvalidLeaderboardWindow
+	}
+}
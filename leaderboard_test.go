@@ -0,0 +1,107 @@
+package dl99
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var leaderboardNow = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+// leaderboardArchives are games finished by ann, ben, cat, dan and the bot
+// eve, each player's rating is the same after every rated game.
+func leaderboardArchives() []*GameArchive {
+	ratings := map[string]float64{"ann": 1600, "ben": 1550, "cat": 1450, "dan": 1400, "eve": 1500}
+	var archives []*GameArchive
+	// count games of ids, the winner first, finished at at
+	add := func(count int, at time.Time, ids ...string) {
+		for i := 0; i < count; i++ {
+			archive := &GameArchive{
+				Id:         fmt.Sprintf("g-%d", len(archives)),
+				FinishedAt: at,
+				Rated:      true,
+			}
+			for placement, id := range ids {
+				bot := id == "eve"
+				if bot {
+					archive.Rated = false
+				}
+				archive.Participants = append(archive.Participants, ArchivedPlayer{
+					Id:        id,
+					Name:      id,
+					Bot:       bot,
+					Placement: placement + 1,
+					Rating:    ratings[id],
+				})
+			}
+			archives = append(archives, archive)
+		}
+	}
+	week := 7 * 24 * time.Hour
+	add(12, leaderboardNow.Add(-10*24*time.Hour), "ann", "dan")
+	add(1, leaderboardNow.Add(-week-time.Second), "ann", "ben")
+	// the weekly window starts right here
+	add(1, leaderboardNow.Add(-week), "cat", "ben")
+	add(10, leaderboardNow.Add(-2*24*time.Hour), "ben", "cat")
+	add(2, leaderboardNow.Add(-2*24*time.Hour), "cat", "ben")
+	add(3, leaderboardNow.Add(-time.Hour), "dan", "eve")
+	return archives
+}
+
+func TestRankLeaderboard(t *testing.T) {
+	tests := []struct {
+		name  string
+		query LeaderboardQuery
+		ids   []string
+		total int
+	}{
+		// ties on wins go to whoever played more
+		{"wins", LeaderboardQuery{Metric: MetricWins}, []string{"ann", "ben", "dan", "cat"}, 4},
+		{"weekly wins", LeaderboardQuery{Metric: MetricWins, Window: WindowWeekly}, []string{"ben", "cat", "dan"}, 3},
+		{"rating", LeaderboardQuery{}, []string{"ann", "ben", "cat", "dan"}, 4},
+		// dan only played the bot this week
+		{"weekly rating", LeaderboardQuery{Window: WindowWeekly}, []string{"ben", "cat"}, 2},
+
+		// dan won all 3 games of the week, short of the 10 by default
+		{"weekly win rate", LeaderboardQuery{Metric: MetricWinRate, Window: WindowWeekly}, []string{"ben", "cat"}, 2},
+		{"weekly win rate of 3 games", LeaderboardQuery{Metric: MetricWinRate, Window: WindowWeekly, MinGames: 3}, []string{"dan", "ben", "cat"}, 3},
+		{"weekly win rate of 14 games", LeaderboardQuery{Metric: MetricWinRate, Window: WindowWeekly, MinGames: 14}, []string{}, 0},
+		{"win rate", LeaderboardQuery{Metric: MetricWinRate}, []string{"ann", "ben", "cat", "dan"}, 4},
+
+		{"first page", LeaderboardQuery{Metric: MetricWins, Limit: 2}, []string{"ann", "ben"}, 4},
+		{"last full page", LeaderboardQuery{Metric: MetricWins, Offset: 2, Limit: 2}, []string{"dan", "cat"}, 4},
+		{"last partial page", LeaderboardQuery{Metric: MetricWins, Offset: 3, Limit: 2}, []string{"cat"}, 4},
+		{"right past the end", LeaderboardQuery{Metric: MetricWins, Offset: 4, Limit: 2}, []string{}, 4},
+		{"far past the end", LeaderboardQuery{Metric: MetricWins, Offset: 40, Limit: 2}, []string{}, 4},
+		{"negative offset", LeaderboardQuery{Metric: MetricWins, Offset: -1, Limit: 1}, []string{"ann"}, 4},
+		{"limit above the max", LeaderboardQuery{Metric: MetricWins, Limit: maxLeaderboardLimit + 1}, []string{"ann", "ben", "dan", "cat"}, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query
+			since, err := query.normalize(leaderboardNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			board := rankLeaderboard(archiveTallies(leaderboardArchives(), since), query)
+
+			ids := make([]string, 0, len(board.Entries))
+			for i, entry := range board.Entries {
+				ids = append(ids, entry.PlayerId)
+				if entry.Rank != query.Offset+i+1 {
+					t.Errorf("%s ranked %d at %d of the page from %d", entry.PlayerId, entry.Rank, i, query.Offset)
+				}
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("ranked %v, want %v", ids, test.ids)
+			}
+			if board.Total != test.total {
+				t.Errorf("total %d, want %d", board.Total, test.total)
+			}
+			if board.Offset != query.Offset || board.Limit != query.Limit {
+				t.Errorf("page %d+%d, want %d+%d", board.Offset, board.Limit, query.Offset, query.Limit)
+			}
+		})
+	}
+}
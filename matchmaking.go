@@ -0,0 +1,278 @@
+package dl99
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	ErrInvalidTableSize = errors.New("invalid table size")
+	ErrInvalidRuleSet   = errors.New("invalid rule set")
+	ErrAlreadyQueued    = errors.New("player already queued")
+	ErrNotQueued        = errors.New("player not queued")
+)
+
+const (
+	// the only rule set so far, see freeBattleGame
+	RuleSetFreeBattle = "free_battle"
+
+	maxTableSize = 8
+)
+
+const (
+	MatchWaiting = "waiting"
+	MatchFound   = "matched"
+)
+
+// MatchStatus tells a queued player whether a game was found yet.
+type MatchStatus struct {
+	State     string    `json:"state"`
+	TableSize int       `json:"table_size"`
+	RuleSet   string    `json:"rule_set"`
+	QueuedAt  time.Time `json:"queued_at"`
+	GameId    string    `json:"game_id,omitempty"`
+}
+
+type matchTicket struct {
+	playerId  string
+	tableSize int
+	ruleSet   string
+	rating    float64
+	queuedAt  time.Time
+
+	// set once a game was formed, the ticket stays around until
+	// MatchStatus told the player the game id, or they left the game
+	gameId string
+}
+
+// ratingBand is how far apart two players' ratings may be to be matched,
+// base <= 0 ignores ratings.
+type ratingBand struct {
+	base float64
+	// added to base for every minute a ticket has waited
+	widenPerMinute float64
+}
+
+func (band ratingBand) width(ticket *matchTicket, now time.Time) float64 {
+	if band.base <= 0 {
+		return math.Inf(1)
+	}
+	return band.base + band.widenPerMinute*now.Sub(ticket.queuedAt).Minutes()
+}
+
+// fits tells whether other may join group, the spread of the ratings of
+// all of them must be within every one's band.
+func (band ratingBand) fits(group []*matchTicket, other *matchTicket, now time.Time) bool {
+	low, high := other.rating, other.rating
+	for _, ticket := range group {
+		low = math.Min(low, ticket.rating)
+		high = math.Max(high, ticket.rating)
+	}
+	spread := high - low
+	if spread > band.width(other, now) {
+		return false
+	}
+	for _, ticket := range group {
+		if spread > band.width(ticket, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRatingBand makes matchmaking only group players whose ratings are at
+// most base apart, widening by widenPerMinute for every minute they wait.
+// base <= 0 matches regardless of rating, which is the default.
+func (srv *server) SetRatingBand(base float64, widenPerMinute float64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.band = ratingBand{base: base, widenPerMinute: widenPerMinute}
+}
+
+// Enqueue puts the player in the matchmaking queue, Matchmake will put them
+// in a game of tableSize players playing ruleSet.
+func (srv *server) Enqueue(playerId string, tableSize int, ruleSet string) error {
+	if tableSize < minPlayers || tableSize > maxTableSize {
+		return ErrInvalidTableSize
+	}
+	if ruleSet == "" {
+		ruleSet = RuleSetFreeBattle
+	}
+	if ruleSet != RuleSetFreeBattle {
+		return ErrInvalidRuleSet
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.draining {
+		return ErrServerDraining
+	}
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+	if player.inGame() {
+		return ErrPlayerAlreadyJoined
+	}
+	if ticket, ok := srv.tickets[playerId]; ok && ticket.gameId == "" {
+		return ErrAlreadyQueued
+	}
+
+	srv.tickets[playerId] = &matchTicket{
+		playerId:  playerId,
+		tableSize: tableSize,
+		ruleSet:   ruleSet,
+		rating:    player.rating,
+		queuedAt:  time.Now(),
+	}
+	log.Printf("player [%s] queued for a %d players %s game", player.name, tableSize, ruleSet)
+	return nil
+}
+
+func (srv *server) Dequeue(playerId string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := srv.tickets[playerId]; !ok {
+		return ErrNotQueued
+	}
+	delete(srv.tickets, playerId)
+	return nil
+}
+
+// MatchStatus tells whether a game was found for the player, once it told
+// the game id the ticket is gone.
+func (srv *server) MatchStatus(playerId string) (MatchStatus, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	ticket, ok := srv.tickets[playerId]
+	if !ok {
+		return MatchStatus{}, ErrNotQueued
+	}
+	status := MatchStatus{
+		State:     MatchWaiting,
+		TableSize: ticket.tableSize,
+		RuleSet:   ticket.ruleSet,
+		QueuedAt:  ticket.queuedAt,
+	}
+	if ticket.gameId != "" {
+		status.State = MatchFound
+		status.GameId = ticket.gameId
+		delete(srv.tickets, playerId)
+	}
+	return status, nil
+}
+
+// Matchmake groups compatible queued players, first come first served, and
+// starts a game for every full group. It returns the number of games
+// started.
+func (srv *server) Matchmake() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.draining {
+		return 0
+	}
+	now := time.Now()
+	waiting := make([]*matchTicket, 0, len(srv.tickets))
+	for _, ticket := range srv.tickets {
+		player, err := srv.findPlayerById(ticket.playerId)
+		if ticket.gameId != "" {
+			// never asked, and done with the game
+			if err != nil || player.gameId != ticket.gameId {
+				delete(srv.tickets, ticket.playerId)
+			}
+			continue
+		}
+		// joined some game by hand in the meantime
+		if err != nil || player.inGame() {
+			delete(srv.tickets, ticket.playerId)
+			continue
+		}
+		waiting = append(waiting, ticket)
+	}
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].queuedAt.Before(waiting[j].queuedAt)
+	})
+
+	started := 0
+	taken := make(map[string]bool, len(waiting))
+	for i, anchor := range waiting {
+		if taken[anchor.playerId] {
+			continue
+		}
+		group := []*matchTicket{anchor}
+		for _, other := range waiting[i+1:] {
+			if len(group) == anchor.tableSize {
+				break
+			}
+			if taken[other.playerId] || other.tableSize != anchor.tableSize || other.ruleSet != anchor.ruleSet {
+				continue
+			}
+			if srv.band.fits(group, other, now) {
+				group = append(group, other)
+			}
+		}
+		if len(group) < anchor.tableSize {
+			continue
+		}
+
+		gameId, err := srv.startMatch(group)
+		if err != nil {
+			log.Printf("start a %d players match failed: %v", anchor.tableSize, err)
+			continue
+		}
+		for _, ticket := range group {
+			taken[ticket.playerId] = true
+			ticket.gameId = gameId
+		}
+		started++
+	}
+	return started
+}
+
+// startMatch creates, joins and starts a game through logged commands, the
+// same way clients would, so the command log can replay it. If that fails
+// the players who joined leave again, their tickets stay queued.
+func (srv *server) startMatch(group []*matchTicket) (string, error) {
+	gameId := randomId(gamePrefix)
+	entry := &logEntry{
+		Op:   opNewGame,
+		Id:   gameId,
+		Name: fmt.Sprintf("Match of %d", len(group)),
+		Seed: time.Now().UnixNano(),
+	}
+	if err := srv.execute(entry); err != nil {
+		return "", err
+	}
+	joined := make([]string, 0, len(group))
+	for _, ticket := range group {
+		if err := srv.execute(&logEntry{Op: opJoinGame, GameId: gameId, PlayerId: ticket.playerId}); err != nil {
+			srv.abandonMatch(gameId, joined)
+			return "", err
+		}
+		joined = append(joined, ticket.playerId)
+	}
+	if err := srv.execute(&logEntry{Op: opStartGame, GameId: gameId, PlayerId: group[0].playerId}); err != nil {
+		srv.abandonMatch(gameId, joined)
+		return "", err
+	}
+	return gameId, nil
+}
+
+// abandonMatch takes the players out of a game startMatch couldn't start,
+// the empty lobby is reaped as unstarted.
+func (srv *server) abandonMatch(gameId string, playerIds []string) {
+	for _, playerId := range playerIds {
+		if err := srv.execute(&logEntry{Op: opForfeit, GameId: gameId, PlayerId: playerId}); err != nil {
+			log.Printf("player [%s] leave abandoned match failed: %v", playerId, err)
+		}
+	}
+}
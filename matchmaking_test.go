@@ -0,0 +1,239 @@
+package dl99
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// queued is a ticket put in the queue waited ago.
+type queued struct {
+	tableSize int
+	ruleSet   string
+	rating    float64
+	waited    time.Duration
+}
+
+func TestMatchmake(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      float64
+		widen     float64
+		tickets   []queued
+		groups    [][]int
+		remaining []int
+	}{
+		{
+			name: "grouped by table size",
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, 5 * time.Second},
+				{3, RuleSetFreeBattle, 1500, 4 * time.Second},
+				{2, RuleSetFreeBattle, 1500, 3 * time.Second},
+				{3, RuleSetFreeBattle, 1500, 2 * time.Second},
+				{3, RuleSetFreeBattle, 1500, time.Second},
+			},
+			groups: [][]int{{0, 2}, {1, 3, 4}},
+		},
+		{
+			name: "a table short",
+			tickets: []queued{
+				{3, RuleSetFreeBattle, 1500, 2 * time.Second},
+				{3, RuleSetFreeBattle, 1500, time.Second},
+			},
+			remaining: []int{0, 1},
+		},
+		{
+			name: "grouped by rule set",
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, 4 * time.Second},
+				{2, "other", 1500, 3 * time.Second},
+				{2, RuleSetFreeBattle, 1500, 2 * time.Second},
+				{2, "other", 1500, time.Second},
+			},
+			groups: [][]int{{0, 2}, {1, 3}},
+		},
+		{
+			name: "first come first served",
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, time.Second},
+				{2, RuleSetFreeBattle, 1500, 3 * time.Second},
+				{2, RuleSetFreeBattle, 1500, 2 * time.Second},
+			},
+			groups:    [][]int{{1, 2}},
+			remaining: []int{0},
+		},
+		{
+			name: "ratings ignored without a band",
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1000, 2 * time.Second},
+				{2, RuleSetFreeBattle, 2500, time.Second},
+			},
+			groups: [][]int{{0, 1}},
+		},
+		{
+			name: "outside the band",
+			base: 100,
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, 3 * time.Second},
+				{2, RuleSetFreeBattle, 1650, 2 * time.Second},
+				{2, RuleSetFreeBattle, 1560, time.Second},
+			},
+			groups:    [][]int{{0, 2}},
+			remaining: []int{1},
+		},
+		{
+			name:  "not waited long enough to widen",
+			base:  100,
+			widen: 50,
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, time.Minute},
+				{2, RuleSetFreeBattle, 1700, time.Minute},
+			},
+			remaining: []int{0, 1},
+		},
+		{
+			name:  "widened by waiting",
+			base:  100,
+			widen: 50,
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, 3 * time.Minute},
+				{2, RuleSetFreeBattle, 1700, 2 * time.Minute},
+			},
+			groups: [][]int{{0, 1}},
+		},
+		{
+			name:  "only one of the two widened",
+			base:  100,
+			widen: 50,
+			tickets: []queued{
+				{2, RuleSetFreeBattle, 1500, 3 * time.Minute},
+				{2, RuleSetFreeBattle, 1700, time.Minute},
+			},
+			remaining: []int{0, 1},
+		},
+		{
+			// 1420 is within 100 of 1500, but 160 from 1580
+			name: "the whole group within the band",
+			base: 100,
+			tickets: []queued{
+				{3, RuleSetFreeBattle, 1500, 4 * time.Second},
+				{3, RuleSetFreeBattle, 1580, 3 * time.Second},
+				{3, RuleSetFreeBattle, 1420, 2 * time.Second},
+				{3, RuleSetFreeBattle, 1510, time.Second},
+			},
+			groups:    [][]int{{0, 1, 3}},
+			remaining: []int{2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := NewServer(0, 0, nil)
+			srv.SetRatingBand(test.base, test.widen)
+
+			playerIds := make([]string, 0, len(test.tickets))
+			for i := range test.tickets {
+				id, _, err := srv.NewPlayer(fmt.Sprintf("p%d", i), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				playerIds = append(playerIds, id)
+			}
+			// straight into the queue, Enqueue knows a single rule set and
+			// stamps the tickets now
+			srv.mu.Lock()
+			now := time.Now()
+			for i, q := range test.tickets {
+				srv.tickets[playerIds[i]] = &matchTicket{
+					playerId:  playerIds[i],
+					tableSize: q.tableSize,
+					ruleSet:   q.ruleSet,
+					rating:    q.rating,
+					queuedAt:  now.Add(-q.waited),
+				}
+			}
+			srv.mu.Unlock()
+
+			if started := srv.Matchmake(); started != len(test.groups) {
+				t.Errorf("started %d games, want %d", started, len(test.groups))
+			}
+
+			byGame := make(map[string][]int)
+			remaining := []int{}
+			for i, id := range playerIds {
+				status, err := srv.MatchStatus(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status.State == MatchWaiting {
+					remaining = append(remaining, i)
+					continue
+				}
+				player, err := srv.PlayerInfo(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if player.GameId != status.GameId {
+					t.Errorf("player %d matched into %s, but is in %q", i, status.GameId, player.GameId)
+				}
+				byGame[status.GameId] = append(byGame[status.GameId], i)
+			}
+			groups := [][]int{}
+			for _, group := range byGame {
+				groups = append(groups, group)
+			}
+			sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+
+			want := test.groups
+			if want == nil {
+				want = [][]int{}
+			}
+			if !reflect.DeepEqual(groups, want) {
+				t.Errorf("grouped %v, want %v", groups, want)
+			}
+			wantRemaining := test.remaining
+			if wantRemaining == nil {
+				wantRemaining = []int{}
+			}
+			if !reflect.DeepEqual(remaining, wantRemaining) {
+				t.Errorf("left waiting %v, want %v", remaining, wantRemaining)
+			}
+		})
+	}
+}
+
+func TestMatchStatusExpiresMatchedTicket(t *testing.T) {
+	srv := NewServer(0, 0, nil)
+	playerIds := make([]string, 0, 2)
+	for _, name := range []string{"a", "b"} {
+		id, _, err := srv.NewPlayer(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Enqueue(id, 2, ""); err != nil {
+			t.Fatal(err)
+		}
+		playerIds = append(playerIds, id)
+	}
+	if started := srv.Matchmake(); started != 1 {
+		t.Fatalf("started %d games, want 1", started)
+	}
+
+	status, err := srv.MatchStatus(playerIds[0])
+	if err != nil || status.State != MatchFound {
+		t.Fatalf("status %+v, %v", status, err)
+	}
+	if _, err := srv.MatchStatus(playerIds[0]); err != ErrNotQueued {
+		t.Errorf("asked again: %v, want ErrNotQueued", err)
+	}
+
+	// b never asks, the ticket goes once b is done with the game
+	if err := srv.LeaveGame(status.GameId, playerIds[1], nil); err != nil && err != ErrLose {
+		t.Fatal(err)
+	}
+	srv.Matchmake()
+	if _, err := srv.MatchStatus(playerIds[1]); err != ErrNotQueued {
+		t.Errorf("after leaving: %v, want ErrNotQueued", err)
+	}
+}
@@ -10,17 +10,34 @@ type player struct {
 	name   string
 	gameId string
 	hand   []Card
+
+	// secret handed out once by NewPlayer, required to act as this player
+	token string
+
+	// username of the owning account, empty for guests
+	account string
+
+	stats PlayerStats
+
+	// bots never take part in rated games
+	bot           bool
+	rating        float64
+	ratingHistory []RatingChange
 }
 
-func newPlayer(name string) *player {
+func newPlayer(id string, name string, token string, bot bool) *player {
 	if name == "" {
 		name = defaultPlayerName
 	}
 	return &player{
-		id:         randomId(playerIdPrefix),
-		name:       name,
-		gameId:     "",
-		hand:       nil,
+		id:     id,
+		name:   name,
+		gameId: "",
+		hand:   nil,
+		token:  token,
+		stats:  newPlayerStats(),
+		bot:    bot,
+		rating: initialRating,
 	}
 }
 
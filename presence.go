@@ -0,0 +1,198 @@
+package dl99
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	PresenceOnline       = "online"
+	PresenceDisconnected = "disconnected"
+)
+
+const (
+	// TurnPause leaves a disconnected player's turn waiting for them
+	TurnPause = "pause"
+	// TurnSkip passes a disconnected player's turn to the next player
+	TurnSkip = "skip"
+)
+
+// PresencePolicy is how the server treats players who stop sending
+// heartbeats.
+type PresencePolicy struct {
+	// silence after which a player is disconnected
+	GracePeriod time.Duration
+	// TurnPause or TurnSkip
+	Turns string
+	// silence after which a player leaves their game, zero never forfeits
+	ForfeitAfter time.Duration
+}
+
+var DefaultPresencePolicy = PresencePolicy{
+	GracePeriod:  30 * time.Second,
+	Turns:        TurnSkip,
+	ForfeitAfter: 5 * time.Minute,
+}
+
+// PresenceReport is what a presence check did.
+type PresenceReport struct {
+	Disconnected []string `json:"disconnected"`
+	// player ids whose turn was skipped
+	Skipped []string `json:"skipped"`
+	// player ids who left their game
+	Forfeited []string `json:"forfeited"`
+}
+
+// presence isn't logged nor snapshotted, after a restart every player gets a
+// new grace period, see CheckPresence.
+type presence struct {
+	lastSeen     time.Time
+	disconnected bool
+}
+
+func (srv *server) SetPresencePolicy(policy PresencePolicy) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.presencePolicy = policy
+}
+
+// Heartbeat marks the player as connected, any authenticated request counts
+// as one.
+func (srv *server) Heartbeat(playerId string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+	p, ok := srv.presence[playerId]
+	if !ok {
+		p = &presence{}
+		srv.presence[playerId] = p
+	}
+	if p.disconnected {
+		log.Printf("player [%s] reconnected", player.name)
+		srv.publish(EventPlayerReconnected, player.gameId, player.id, nil)
+	}
+	p.lastSeen = time.Now()
+	p.disconnected = false
+	return nil
+}
+
+// presenceOf tells whether the player is connected, players not seen since
+// the server started count as online until the next CheckPresence.
+func (srv *server) presenceOf(playerId string) string {
+	if p, ok := srv.presence[playerId]; ok && p.disconnected {
+		return PresenceDisconnected
+	}
+	return PresenceOnline
+}
+
+// anyoneOnline tells whether a player still in the game is connected.
+func (srv *server) anyoneOnline(game *freeBattleGame) bool {
+	for _, player := range game.players {
+		if srv.presenceOf(player.id) == PresenceOnline {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPresence disconnects players silent for longer than the grace
+// period, skips their turns if the policy says so, and makes players silent
+// for longer than ForfeitAfter leave their game.
+func (srv *server) CheckPresence() PresenceReport {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	report := PresenceReport{
+		Disconnected: make([]string, 0),
+		Skipped:      make([]string, 0),
+		Forfeited:    make([]string, 0),
+	}
+
+	players, err := srv.store.ListPlayers()
+	if err != nil {
+		log.Printf("list players failed: %v", err)
+		return report
+	}
+
+	now := time.Now()
+	policy := srv.presencePolicy
+	for _, player := range players {
+		p, ok := srv.presence[player.id]
+		if !ok {
+			srv.presence[player.id] = &presence{lastSeen: now}
+			continue
+		}
+		silence := now.Sub(p.lastSeen)
+		if silence < policy.GracePeriod {
+			continue
+		}
+		if !p.disconnected {
+			p.disconnected = true
+			report.Disconnected = append(report.Disconnected, player.id)
+			log.Printf("player [%s] disconnected", player.name)
+			srv.publish(EventPlayerDisconnected, player.gameId, player.id, nil)
+		}
+		if !player.inGame() {
+			continue
+		}
+		game, err := srv.findGameById(player.gameId)
+		if err != nil || game.paused {
+			continue
+		}
+
+		// forfeit and skip are logged like the players' own commands, so
+		// the command log replays them
+		if policy.ForfeitAfter > 0 && silence >= policy.ForfeitAfter {
+			if err := srv.execute(&logEntry{Op: opForfeit, GameId: player.gameId, PlayerId: player.id}); err != nil && err != ErrLose {
+				log.Printf("player [%s] forfeit failed: %v", player.name, err)
+				continue
+			}
+			report.Forfeited = append(report.Forfeited, player.id)
+			continue
+		}
+
+		if policy.Turns != TurnSkip {
+			continue
+		}
+		if game.state != GameStarted || game.nextPlayerId != player.id {
+			continue
+		}
+		// with nobody left to play, skipping would go round forever, let
+		// the game go stale and be reaped instead
+		if !srv.anyoneOnline(game) {
+			continue
+		}
+		if err := srv.execute(&logEntry{Op: opSkipTurn, GameId: game.id, PlayerId: player.id}); err != nil {
+			log.Printf("player [%s] skip turn failed: %v", player.name, err)
+			continue
+		}
+		report.Skipped = append(report.Skipped, player.id)
+	}
+	return report
+}
+
+func (srv *server) skipTurn(gameId string, playerId string) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+
+	err = game.skipTurn(player, srv.now)
+	if serr := srv.putGame(game); serr != nil {
+		return serr
+	}
+	if err == nil {
+		srv.publish(EventTurnSkipped, game.id, player.id, nil)
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package dl99
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"log"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrHostRequired   = errors.New("private games need a host")
+	ErrNotHost        = errors.New("you are not the host of this game")
+	ErrPrivateGame    = errors.New("private game, invite code or password incorrect")
+	ErrNotPrivateGame = errors.New("not a private game")
+	ErrNotInvited     = errors.New("not invited to this game")
+	ErrAlreadyInvited = errors.New("player already invited")
+)
+
+const (
+	inviteCodeLength = 6
+	// no 0/O or 1/I, codes get read out loud
+	inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+type GameOptions struct {
+	// the player creating the game, required for private games
+	HostId string
+
+	// private games are hidden from GameBriefs and can only be joined with
+	// the invite code, the password or an invitation
+	Private bool
+
+	// optional, setting it makes the game private
+	Password string
+}
+
+// Invitation is a pending invitation of a player to a private game.
+type Invitation struct {
+	GameId   string `json:"game_id"`
+	GameName string `json:"game_name"`
+	HostId   string `json:"host_id"`
+}
+
+func randomInviteCode() string {
+	buf := make([]byte, inviteCodeLength)
+	if _, err := crand.Read(buf); err != nil {
+		panic(err)
+	}
+	for i := range buf {
+		buf[i] = inviteCodeAlphabet[int(buf[i])%len(inviteCodeAlphabet)]
+	}
+	return string(buf)
+}
+
+func (game *freeBattleGame) invited(playerId string) bool {
+	for _, id := range game.invitations {
+		if id == playerId {
+			return true
+		}
+	}
+	return false
+}
+
+func (game *freeBattleGame) uninvite(playerId string) bool {
+	for i, id := range game.invitations {
+		if id == playerId {
+			game.invitations = append(game.invitations[:i], game.invitations[i+1:]...)
+			game.touch()
+			return true
+		}
+	}
+	return false
+}
+
+// admits tells whether the player may join, without touching the password
+// hash, which is checked separately since bcrypt is slow.
+func (game *freeBattleGame) admits(playerId string, inviteCode string) bool {
+	if !game.private {
+		return true
+	}
+	if playerId == game.hostId || game.invited(playerId) {
+		return true
+	}
+	return inviteCode != "" && tokenEqual(game.inviteCode, inviteCode)
+}
+
+// checkJoin checks that the player may join the game, a private one needs
+// the player to be the host, an invitation, the invite code or the password.
+func (srv *server) checkJoin(gameId string, playerId string, inviteCode string, password string) error {
+	srv.mu.RLock()
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		srv.mu.RUnlock()
+		return err
+	}
+	admitted := game.admits(playerId, inviteCode)
+	hash := game.passwordHash
+	srv.mu.RUnlock()
+
+	if admitted {
+		return nil
+	}
+	if len(hash) > 0 && password != "" && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+		return nil
+	}
+	return ErrPrivateGame
+}
+
+// hostedGame returns the game if playerId is its host.
+func (srv *server) hostedGame(gameId string, playerId string) (*freeBattleGame, error) {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return nil, err
+	}
+	if game.hostId == "" || game.hostId != playerId {
+		return nil, ErrNotHost
+	}
+	return game, nil
+}
+
+// InviteCode returns the invite code of a private game to its host.
+func (srv *server) InviteCode(gameId string, hostId string) (string, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	game, err := srv.hostedGame(gameId, hostId)
+	if err != nil {
+		return "", err
+	}
+	if !game.private {
+		return "", ErrNotPrivateGame
+	}
+	return game.inviteCode, nil
+}
+
+// RegenerateInviteCode replaces the invite code of a private game, the old
+// one no longer works.
+func (srv *server) RegenerateInviteCode(gameId string, hostId string, ifVersion *uint64) (string, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return "", err
+	}
+	game, err := srv.hostedGame(gameId, hostId)
+	if err != nil {
+		return "", err
+	}
+	if !game.private {
+		return "", ErrNotPrivateGame
+	}
+
+	code := randomInviteCode()
+	if err := srv.logCommand(&logEntry{Op: opInviteCode, GameId: gameId, PlayerId: hostId, Text: code}); err != nil {
+		return "", err
+	}
+	if err := srv.setInviteCode(gameId, hostId, code); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (srv *server) setInviteCode(gameId string, hostId string, code string) error {
+	game, err := srv.hostedGame(gameId, hostId)
+	if err != nil {
+		return err
+	}
+	game.inviteCode = code
+	game.touch()
+	log.Printf("game [%s] invite code regenerated", game.name)
+	return srv.store.PutGame(game)
+}
+
+// Invite lets the host invite a player, who can then accept by joining or
+// decline.
+func (srv *server) Invite(gameId string, hostId string, playerId string, ifVersion *uint64) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opInvite, GameId: gameId, Id: hostId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.invite(gameId, hostId, playerId)
+}
+
+func (srv *server) invite(gameId string, hostId string, playerId string) error {
+	game, err := srv.hostedGame(gameId, hostId)
+	if err != nil {
+		return err
+	}
+	if !game.private {
+		return ErrNotPrivateGame
+	}
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+	if player.gameId == game.id {
+		return ErrPlayerAlreadyJoined
+	}
+	if game.invited(playerId) {
+		return ErrAlreadyInvited
+	}
+	game.invitations = append(game.invitations, playerId)
+	game.touch()
+	return srv.store.PutGame(game)
+}
+
+func (srv *server) DeclineInvitation(gameId string, playerId string, ifVersion *uint64) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opDecline, GameId: gameId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.declineInvitation(gameId, playerId)
+}
+
+func (srv *server) declineInvitation(gameId string, playerId string) error {
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return err
+	}
+	if !game.uninvite(playerId) {
+		return ErrNotInvited
+	}
+	return srv.store.PutGame(game)
+}
+
+// Invitations lists the player's pending invitations, accept one with
+// JoinGame.
+func (srv *server) Invitations(playerId string) ([]Invitation, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	games, err := srv.store.ListGames()
+	if err != nil {
+		return nil, err
+	}
+	invitations := make([]Invitation, 0)
+	for _, game := range games {
+		if game.state == GameCreated && game.invited(playerId) {
+			invitations = append(invitations, Invitation{
+				GameId:   game.id,
+				GameName: game.name,
+				HostId:   game.hostId,
+			})
+		}
+	}
+	return invitations, nil
+}
@@ -0,0 +1,83 @@
+package dl99
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	initialRating = 1500.0
+
+	// the most a player can win or lose in one game, split across all
+	// opponents
+	ratingK = 32.0
+)
+
+// RatingChange is one entry of a player's rating history.
+type RatingChange struct {
+	GameId    string    `json:"game_id"`
+	Placement int       `json:"placement"`
+	Players   int       `json:"players"`
+	Rating    float64   `json:"rating"`
+	Delta     float64   `json:"delta"`
+	At        time.Time `json:"at"`
+}
+
+// rated tells whether a finished game counts for ratings: no bots at the
+// table, and at least two participants actually played, otherwise the game
+// was abandoned.
+func (game *freeBattleGame) rated(participants []*player) bool {
+	if len(participants) < minPlayers {
+		return false
+	}
+	for _, player := range participants {
+		if player.bot {
+			return false
+		}
+	}
+	active := 0
+	for _, tally := range game.tallies {
+		if tally.Turns > 0 {
+			active++
+		}
+	}
+	return active >= minPlayers
+}
+
+// rateGame applies pairwise multiplayer Elo: every participant plays one
+// match against each other participant, won by whoever placed better, and
+// the K factor is shared across those matches.
+func rateGame(game *freeBattleGame, participants []*player, at time.Time) {
+	n := len(participants)
+	ratings := make([]float64, n)
+	placements := make([]int, n)
+	for i, player := range participants {
+		ratings[i] = player.rating
+		placements[i] = game.placement(player.id)
+	}
+
+	k := ratingK / float64(n-1)
+	for i, player := range participants {
+		delta := 0.0
+		for j := range participants {
+			if i == j {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, (ratings[j]-ratings[i])/400))
+			actual := 0.0
+			if placements[i] < placements[j] {
+				actual = 1
+			}
+			delta += k * (actual - expected)
+		}
+		player.rating = ratings[i] + delta
+		player.ratingHistory = append(player.ratingHistory, RatingChange{
+			GameId:    game.id,
+			Placement: placements[i],
+			Players:   n,
+			Rating:    player.rating,
+			Delta:     delta,
+			At:        at,
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package dl99
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// seat is a participant of a finished game, see finishedGame.
+type seat struct {
+	rating float64
+	bot    bool
+	turns  int
+}
+
+// finishedGame is a game the seats finished in order, the winner first.
+func finishedGame(seats []seat) (*freeBattleGame, []*player) {
+	game := newGame("g-rated", "", 1)
+	game.state = GameFinished
+	game.tallies = make(map[string]*gameTally, len(seats))
+	participants := make([]*player, 0, len(seats))
+	for i, s := range seats {
+		player := newPlayer(fmt.Sprintf("p-%d", i), fmt.Sprintf("p%d", i), "", s.bot)
+		player.rating = s.rating
+		participants = append(participants, player)
+		game.participants = append(game.participants, player.id)
+		tally := newGameTally()
+		tally.Turns = s.turns
+		game.tallies[player.id] = tally
+	}
+	// standings go from the first out to the winner
+	for i := len(participants) - 1; i >= 0; i-- {
+		game.standings = append(game.standings, participants[i].id)
+	}
+	return game, participants
+}
+
+func TestRateGame(t *testing.T) {
+	tests := []struct {
+		name    string
+		ratings []float64
+	}{
+		{"two even", []float64{1500, 1500}},
+		{"two, the favorite wins", []float64{1800, 1400}},
+		{"two, the underdog wins", []float64{1400, 1800}},
+		{"three even", []float64{1500, 1500, 1500}},
+		{"four mixed", []float64{1320, 1710, 1500, 1605}},
+		{"eight mixed", []float64{1500, 1200, 1900, 1450, 1610, 1333, 1777, 1500}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seats := make([]seat, len(test.ratings))
+			for i, rating := range test.ratings {
+				seats[i] = seat{rating: rating, turns: 1}
+			}
+			game, participants := finishedGame(seats)
+			at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			rateGame(game, participants, at)
+
+			sum := 0.0
+			for i, player := range participants {
+				if len(player.ratingHistory) != 1 {
+					t.Fatalf("player %d has %d rating changes, want 1", i, len(player.ratingHistory))
+				}
+				change := player.ratingHistory[0]
+				if change.Placement != i+1 || change.Players != len(participants) || !change.At.Equal(at) {
+					t.Errorf("player %d change %+v", i, change)
+				}
+				if math.Abs(test.ratings[i]+change.Delta-player.rating) > 1e-9 || change.Rating != player.rating {
+					t.Errorf("player %d rating %v, from %v by %v", i, player.rating, test.ratings[i], change.Delta)
+				}
+				sum += change.Delta
+			}
+			if math.Abs(sum) > 1e-9 {
+				t.Errorf("deltas sum to %v, want 0", sum)
+			}
+			if winner := participants[0].ratingHistory[0].Delta; winner <= 0 {
+				t.Errorf("winner delta %v, want positive", winner)
+			}
+			if loser := participants[len(participants)-1].ratingHistory[0].Delta; loser >= 0 {
+				t.Errorf("last place delta %v, want negative", loser)
+			}
+		})
+	}
+}
+
+func TestGameRated(t *testing.T) {
+	tests := []struct {
+		name  string
+		seats []seat
+		rated bool
+	}{
+		{"two humans", []seat{{1500, false, 3}, {1500, false, 2}}, true},
+		{"four humans", []seat{{1500, false, 3}, {1500, false, 2}, {1500, false, 1}, {1500, false, 1}}, true},
+		{"a bot at the table", []seat{{1500, false, 3}, {1500, true, 2}}, false},
+		{"a bot won", []seat{{1500, true, 3}, {1500, false, 2}, {1500, false, 2}}, false},
+		{"abandoned, nobody played", []seat{{1500, false, 0}, {1500, false, 0}}, false},
+		{"abandoned, one player played", []seat{{1500, false, 4}, {1500, false, 0}, {1500, false, 0}}, false},
+		{"a single participant", []seat{{1500, false, 4}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			game, participants := finishedGame(test.seats)
+			if rated := game.rated(participants); rated != test.rated {
+				t.Errorf("rated %v, want %v", rated, test.rated)
+			}
+		})
+	}
+}
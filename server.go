@@ -1,8 +1,14 @@
 package dl99
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,6 +22,8 @@ var (
 	ErrPlayerNotFound      = errors.New("player not found")
 	ErrGameNotFound        = errors.New("game not found")
 	ErrYouAreNotInThisGame = errors.New("you are not in this game")
+	ErrInvalidToken        = errors.New("invalid player token")
+	ErrVersionMismatch     = errors.New("the game changed since, get it again")
 )
 
 type GameBrief struct {
@@ -27,88 +35,351 @@ type GameBrief struct {
 
 type GameDetail struct {
 	GameBrief
+	HostId       string        `json:"host_id"`
+	Private      bool          `json:"private"`
 	Score        int           `json:"score"`
 	NextPlayerId string        `json:"next_player_id"`
 	Clockwise    bool          `json:"clock_wise"`
 	Players      []PlayerBrief `json:"players"`
+	// bumped by every change to the game, see WaitGame
+	Version uint64 `json:"version"`
 }
 
 type PlayerBrief struct {
 	Id            string `json:"id"`
 	Name          string `json:"name"`
 	HandCardCount int    `json:"hand_card_count"`
+	// PresenceOnline or PresenceDisconnected
+	Presence string `json:"presence"`
 }
 
 type PlayerDetail struct {
 	PlayerBrief
-	HandCards []string `json:"hand_cards"`
+	// empty when not in a game
+	GameId        string         `json:"game_id"`
+	HandCards     []string       `json:"hand_cards"`
+	Bot           bool           `json:"bot"`
+	Rating        float64        `json:"rating"`
+	RatingHistory []RatingChange `json:"rating_history"`
 }
 
 type server struct {
 	mu         *sync.RWMutex
-	players    []*player
+	store      Store
 	maxPlayers int
-	games      []*freeBattleGame
 	maxGames   int
+
+	// session token -> session, kept in memory only, logging in again after
+	// a restart is fine
+	sessions map[string]*session
+
+	// matchmaking queue, player id -> ticket, not persisted
+	tickets map[string]*matchTicket
+	band    ratingBand
+
+	retention archiveRetention
+	cleanup   CleanupPolicy
+	reapHooks []func(ReapedGame)
+
+	presence       map[string]*presence
+	presencePolicy PresencePolicy
+
+	events *eventBus
+
+	// see Drain
+	draining bool
+
+	sessionTTL time.Duration
+
+	// persistence, disabled until EnablePersistence is called
+	dataDir string
+	wal     *commandLog
+	logSeq  uint64
+
+	// time of the command being applied, replaying uses the logged time so
+	// the rebuilt state is the same
+	now time.Time
 }
 
-func NewServer(maxPlayers, maxGames int) *server {
+// NewServer creates a server keeping its players and games in store, a nil
+// store means NewMemoryStore().
+func NewServer(maxPlayers, maxGames int, store Store) *server {
 	if maxPlayers <= 0 {
 		maxPlayers = DefaultMaxPlayers
 	}
 	if maxGames <= 0 {
 		maxGames = DefaultMaxGames
 	}
+	if store == nil {
+		store = NewMemoryStore()
+	}
 	return &server{
 		mu:         &sync.RWMutex{},
-		players:    make([]*player, 0, maxPlayers),
+		store:      store,
 		maxPlayers: maxPlayers,
-		games:      make([]*freeBattleGame, 0, maxGames),
 		maxGames:   maxGames,
+		sessions:   make(map[string]*session),
+		tickets:    make(map[string]*matchTicket),
+		retention: archiveRetention{
+			maxArchives: DefaultMaxArchives,
+			maxAge:      DefaultMaxArchiveAge,
+		},
+		cleanup: DefaultCleanupPolicy,
+
+		presence:       make(map[string]*presence),
+		presencePolicy: DefaultPresencePolicy,
+
+		events: newEventBus(),
+
+		sessionTTL: DefaultSessionTTL,
 	}
 }
 
 func (srv *server) findPlayerById(id string) (*player, error) {
-	for _, player := range srv.players {
-		if player.id == id {
-			return player, nil
-		}
-	}
-	return nil, ErrPlayerNotFound
+	return srv.store.GetPlayer(id)
 }
 
 func (srv *server) findGameById(id string) (*freeBattleGame, error) {
-	for _, game := range srv.games {
-		if game.id == id {
-			return game, nil
+	return srv.store.GetGame(id)
+}
+
+// saveGame puts the game and every player it touched back into the store,
+// a player did something in the game. players are the ones which may no
+// longer be in game.players, e.g. a player who just left.
+func (srv *server) saveGame(game *freeBattleGame, players ...*player) error {
+	game.activeAt = srv.now
+	return srv.putGame(game, players...)
+}
+
+// putGame is saveGame for changes the server made on its own, which don't
+// keep the game from being reaped as inactive.
+func (srv *server) putGame(game *freeBattleGame, players ...*player) error {
+	for _, player := range append(players, game.players...) {
+		if err := srv.store.PutPlayer(player); err != nil {
+			return err
 		}
 	}
-	return nil, ErrGameNotFound
+	return srv.store.PutGame(game)
 }
 
-func (srv *server) NewPlayer(name string) (string, error) {
+// NewPlayer returns the new player's public id and the secret token needed
+// to act as that player, see Authenticate. Bots never affect ratings.
+func (srv *server) NewPlayer(name string, bot bool) (string, string, error) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
-	if len(srv.players) > srv.maxPlayers {
+	id := randomId(playerIdPrefix)
+	token := randomToken()
+	if err := srv.logCommand(&logEntry{Op: opNewPlayer, Id: id, Name: name, Token: token, Bot: bot}); err != nil {
+		return "", "", err
+	}
+	if _, err := srv.newPlayer(id, name, token, bot); err != nil {
+		return "", "", err
+	}
+	srv.presence[id] = &presence{lastSeen: time.Now()}
+	return id, token, nil
+}
+
+func (srv *server) newPlayer(id string, name string, token string, bot bool) (string, error) {
+	players, err := srv.store.ListPlayers()
+	if err != nil {
+		return "", err
+	}
+	if len(players) > srv.maxPlayers {
 		return "", ErrTooMuchPlayers
 	}
 
-	player := newPlayer(name)
-	srv.players = append(srv.players, player)
+	player := newPlayer(id, name, token, bot)
+	if err := srv.store.PutPlayer(player); err != nil {
+		return "", err
+	}
+	srv.publish(EventPlayerCreated, "", player.id, nil)
 	return player.id, nil
 }
 
-func (srv *server) NewGame(name string) (string, error) {
+// Authenticate checks that token is the one NewPlayer handed out for
+// playerId, or a live session of the account owning playerId.
+func (srv *server) Authenticate(playerId string, token string) error {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return ErrInvalidToken
+	}
+	if player.token != "" && tokenEqual(player.token, token) {
+		return nil
+	}
+	if session, ok := srv.sessions[token]; ok && session.playerId == playerId && time.Now().Before(session.expiresAt) {
+		return nil
+	}
+	return ErrInvalidToken
+}
+
+// Register creates an account and the player owned by it, returning the
+// player id. Use Login to get a token for that player.
+func (srv *server) Register(username string, password string) (string, error) {
+	if !usernamePattern.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+	// hash outside the lock, bcrypt is slow on purpose
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, err := srv.store.GetAccount(username); err == nil {
+		return "", ErrUsernameTaken
+	}
+
+	id := randomId(playerIdPrefix)
+	if err := srv.logCommand(&logEntry{Op: opRegister, Id: id, Name: username, Password: hash}); err != nil {
+		return "", err
+	}
+	return srv.register(id, username, hash)
+}
+
+func (srv *server) register(id string, username string, hash []byte) (string, error) {
+	if _, err := srv.store.GetAccount(username); err == nil {
+		return "", ErrUsernameTaken
+	}
+
+	// account players have no token, they authenticate with sessions
+	if _, err := srv.newPlayer(id, username, "", false); err != nil {
+		return "", err
+	}
+	player, err := srv.findPlayerById(id)
+	if err != nil {
+		return "", err
+	}
+	player.account = username
+	if err := srv.store.PutPlayer(player); err != nil {
+		return "", err
+	}
+
+	account := &account{
+		username:     username,
+		passwordHash: hash,
+		playerId:     id,
+		createdAt:    srv.now,
+	}
+	if err := srv.store.PutAccount(account); err != nil {
+		return "", err
+	}
+	log.Printf("account [%s] registered with player [%s]", username, id)
+	return id, nil
+}
+
+// Login checks the password and opens a session, returning the account's
+// player id and the session token to use with Authenticate.
+func (srv *server) Login(username string, password string) (string, string, error) {
+	srv.mu.RLock()
+	account, err := srv.store.GetAccount(username)
+	srv.mu.RUnlock()
+	if err != nil {
+		return "", "", ErrInvalidCredentials
+	}
+	if !account.checkPassword(password) {
+		return "", "", ErrInvalidCredentials
+	}
+
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
-	if len(srv.games) > srv.maxGames {
+	now := time.Now()
+	for token, session := range srv.sessions {
+		if now.After(session.expiresAt) {
+			delete(srv.sessions, token)
+		}
+	}
+
+	token := randomToken()
+	srv.sessions[token] = &session{
+		playerId:  account.playerId,
+		expiresAt: now.Add(srv.sessionTTL),
+	}
+	return account.playerId, token, nil
+}
+
+// Logout ends the session, guest tokens can't be logged out.
+func (srv *server) Logout(token string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := srv.sessions[token]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(srv.sessions, token)
+	return nil
+}
+
+func (srv *server) NewGame(name string, options GameOptions) (string, error) {
+	entry := &logEntry{
+		Op:       opNewGame,
+		Id:       randomId(gamePrefix),
+		Name:     name,
+		Seed:     time.Now().UnixNano(),
+		PlayerId: options.HostId,
+		Private:  options.Private || options.Password != "",
+	}
+	if entry.Private {
+		if options.HostId == "" {
+			return "", ErrHostRequired
+		}
+		entry.Text = randomInviteCode()
+	}
+	if options.Password != "" {
+		// hash outside the lock, bcrypt is slow on purpose
+		hash, err := hashPassword(options.Password)
+		if err != nil {
+			return "", err
+		}
+		entry.Password = hash
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.draining {
+		return "", ErrServerDraining
+	}
+	if options.HostId != "" {
+		if _, err := srv.findPlayerById(options.HostId); err != nil {
+			return "", err
+		}
+	}
+
+	if err := srv.logCommand(entry); err != nil {
+		return "", err
+	}
+	return srv.newGame(entry)
+}
+
+func (srv *server) newGame(entry *logEntry) (string, error) {
+	games, err := srv.store.ListGames()
+	if err != nil {
+		return "", err
+	}
+	if len(games) > srv.maxGames {
 		return "", ErrTooMuchGames
 	}
 
-	game := newGame(name)
-	srv.games = append(srv.games, game)
+	game := newGame(entry.Id, entry.Name, entry.Seed)
+	game.hostId = entry.PlayerId
+	game.private = entry.Private
+	game.inviteCode = entry.Text
+	game.passwordHash = entry.Password
+	game.activeAt = srv.now
+	if err := srv.store.PutGame(game); err != nil {
+		return "", err
+	}
+	srv.publish(EventGameCreated, game.id, game.hostId, nil)
 	return game.id, nil
 }
 
@@ -116,8 +387,16 @@ func (srv *server) GameBriefs() []GameBrief {
 	srv.mu.RLock()
 	defer srv.mu.RUnlock()
 
-	games := make([]GameBrief, 0, len(srv.games))
-	for _, game := range srv.games {
+	all, err := srv.store.ListGames()
+	if err != nil {
+		log.Printf("list games failed: %v", err)
+	}
+
+	games := make([]GameBrief, 0, len(all))
+	for _, game := range all {
+		if game.private {
+			continue
+		}
 		games = append(games, GameBrief{
 			Id:          game.id,
 			Name:        game.name,
@@ -129,10 +408,26 @@ func (srv *server) GameBriefs() []GameBrief {
 	return games
 }
 
-func (srv *server) JoinGame(gameId string, playerId string) error {
+// JoinGame joins the player to the game. A private game also needs its
+// invite code or its password, unless the player was invited.
+func (srv *server) JoinGame(gameId string, playerId string, inviteCode string, password string, ifVersion *uint64) error {
+	if err := srv.checkJoin(gameId, playerId, inviteCode, password); err != nil {
+		return err
+	}
+
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opJoinGame, GameId: gameId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.joinGame(gameId, playerId)
+}
+
+func (srv *server) joinGame(gameId string, playerId string) error {
 	game, err := srv.findGameById(gameId)
 	if err != nil {
 		return err
@@ -143,13 +438,42 @@ func (srv *server) JoinGame(gameId string, playerId string) error {
 		return err
 	}
 
-	return game.join(player)
+	err = game.join(player, srv.now)
+	if serr := srv.saveGame(game, player); serr != nil {
+		return serr
+	}
+	if err == nil {
+		srv.publish(EventPlayerJoined, game.id, player.id, nil)
+	}
+	return err
 }
 
-func (srv *server) LeaveGame(gameId string, playerId string) error {
+func (srv *server) LeaveGame(gameId string, playerId string, ifVersion *uint64) error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opLeaveGame, GameId: gameId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.leaveGame(gameId, playerId)
+}
+
+func (srv *server) leaveGame(gameId string, playerId string) error {
+	return srv.removePlayer(gameId, playerId, srv.saveGame)
+}
+
+// forfeit is leaveGame for a player the server made leave, which isn't
+// activity in the game.
+func (srv *server) forfeit(gameId string, playerId string) error {
+	return srv.removePlayer(gameId, playerId, srv.putGame)
+}
+
+// removePlayer takes the player out of the game, save is saveGame or
+// putGame.
+func (srv *server) removePlayer(gameId string, playerId string, save func(*freeBattleGame, ...*player) error) error {
 	game, err := srv.findGameById(gameId)
 	if err != nil {
 		return err
@@ -160,13 +484,34 @@ func (srv *server) LeaveGame(gameId string, playerId string) error {
 		return err
 	}
 
-	return game.leave(player, false)
+	finished := game.state == GameFinished
+	err = game.leave(player, false, srv.now)
+	if err == nil || err == ErrLose {
+		srv.publish(EventPlayerLeft, game.id, player.id, nil)
+	}
+	if !finished && game.state == GameFinished {
+		srv.gameFinished(game)
+	}
+	if serr := save(game, player); serr != nil {
+		return serr
+	}
+	return err
 }
 
-func (srv *server) StartGame(gameId string, playerId string) error {
+func (srv *server) StartGame(gameId string, playerId string, ifVersion *uint64) error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	if err := srv.logCommand(&logEntry{Op: opStartGame, GameId: gameId, PlayerId: playerId}); err != nil {
+		return err
+	}
+	return srv.startGame(gameId, playerId)
+}
+
+func (srv *server) startGame(gameId string, playerId string) error {
 	game, err := srv.findGameById(gameId)
 	if err != nil {
 		return err
@@ -181,7 +526,15 @@ func (srv *server) StartGame(gameId string, playerId string) error {
 		return ErrYouAreNotInThisGame
 	}
 
-	return game.startGame()
+	err = game.startGame()
+	if err == nil {
+		game.startedAt = srv.now
+		srv.publish(EventGameStarted, game.id, player.id, nil)
+	}
+	if serr := srv.saveGame(game); serr != nil {
+		return serr
+	}
+	return err
 }
 
 func (srv *server) GameInfo(gameId string) (GameDetail, error) {
@@ -192,13 +545,60 @@ func (srv *server) GameInfo(gameId string) (GameDetail, error) {
 	if err != nil {
 		return GameDetail{}, err
 	}
+	return srv.gameDetail(game), nil
+}
+
+// WaitGame returns the game once its version is past version, or as it is
+// when timeout runs out or ctx is done.
+func (srv *server) WaitGame(ctx context.Context, gameId string, version uint64, timeout time.Duration) (GameDetail, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		srv.mu.RLock()
+		game, err := srv.findGameById(gameId)
+		if err != nil {
+			srv.mu.RUnlock()
+			return GameDetail{}, err
+		}
+		if game.version > version {
+			detail := srv.gameDetail(game)
+			srv.mu.RUnlock()
+			return detail, nil
+		}
+		changed := game.watch()
+		srv.mu.RUnlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return srv.GameInfo(gameId)
+		case <-ctx.Done():
+			return srv.GameInfo(gameId)
+		}
+	}
+}
+
+// GameMoves returns the cards played in the game so far, oldest first.
+func (srv *server) GameMoves(gameId string) ([]Move, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return nil, err
+	}
+	return append(make([]Move, 0, len(game.moves)), game.moves...), nil
+}
 
+func (srv *server) gameDetail(game *freeBattleGame) GameDetail {
 	players := make([]PlayerBrief, 0, len(game.players))
 	for _, player := range game.players {
 		players = append(players, PlayerBrief{
 			Id:            player.id,
 			Name:          player.name,
 			HandCardCount: len(player.hand),
+			Presence:      srv.presenceOf(player.id),
 		})
 	}
 
@@ -209,11 +609,14 @@ func (srv *server) GameInfo(gameId string) (GameDetail, error) {
 			State:       game.state,
 			PlayerCount: len(game.players),
 		},
+		HostId:       game.hostId,
+		Private:      game.private,
 		Score:        game.score,
 		NextPlayerId: game.nextPlayerId,
 		Clockwise:    game.clockwise,
 		Players:      players,
-	}, nil
+		Version:      game.version,
+	}
 }
 
 func (srv *server) PlayerInfo(playerId string) (PlayerDetail, error) {
@@ -229,8 +632,13 @@ func (srv *server) PlayerInfo(playerId string) (PlayerDetail, error) {
 			Id:            player.id,
 			Name:          player.name,
 			HandCardCount: len(player.hand),
+			Presence:      srv.presenceOf(player.id),
 		},
-		HandCards: make([]string, 0, len(player.hand)),
+		GameId:        player.gameId,
+		HandCards:     make([]string, 0, len(player.hand)),
+		Bot:           player.bot,
+		Rating:        player.rating,
+		RatingHistory: append([]RatingChange(nil), player.ratingHistory...),
 	}
 	for _, card := range player.hand {
 		pd.HandCards = append(pd.HandCards, card.Name())
@@ -238,10 +646,27 @@ func (srv *server) PlayerInfo(playerId string) (PlayerDetail, error) {
 	return pd, nil
 }
 
-func (srv *server) PlayCard(gameId string, playerId string, cardIndex int, cardOption *CardOption) error {
+func (srv *server) PlayCard(gameId string, playerId string, cardIndex int, cardOption *CardOption, ifVersion *uint64) error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
+	if err := srv.checkVersion(gameId, ifVersion); err != nil {
+		return err
+	}
+	entry := &logEntry{
+		Op:         opPlayCard,
+		GameId:     gameId,
+		PlayerId:   playerId,
+		CardIndex:  cardIndex,
+		CardOption: cardOption,
+	}
+	if err := srv.logCommand(entry); err != nil {
+		return err
+	}
+	return srv.playCard(gameId, playerId, cardIndex, cardOption)
+}
+
+func (srv *server) playCard(gameId string, playerId string, cardIndex int, cardOption *CardOption) error {
 	game, err := srv.findGameById(gameId)
 	if err != nil {
 		return err
@@ -252,23 +677,362 @@ func (srv *server) PlayCard(gameId string, playerId string, cardIndex int, cardO
 		return err
 	}
 
-	return game.play(player, cardIndex, cardOption)
+	finished := game.state == GameFinished
+	moves := len(game.moves)
+	err = game.play(player, cardIndex, cardOption, srv.now)
+	if len(game.moves) > moves {
+		game.moves[len(game.moves)-1].At = srv.now
+		srv.publish(EventCardPlayed, game.id, player.id, game.moves[len(game.moves)-1])
+	}
+	if !finished && game.state == GameFinished {
+		srv.gameFinished(game)
+	}
+	if serr := srv.saveGame(game, player); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// gameFinished is called once, right after game reached GameFinished.
+func (srv *server) gameFinished(game *freeBattleGame) {
+	participants := make([]*player, 0, len(game.participants))
+	for _, id := range game.participants {
+		// not out nor a winner, e.g. dropped before drop left the
+		// participants, it would beat everyone in the rating
+		if game.placement(id) == 0 {
+			log.Printf("game [%s] participant [%s] has no placement, left out", game.name, id)
+			continue
+		}
+		player, err := srv.findPlayerById(id)
+		if err != nil {
+			log.Printf("game [%s] participant [%s] not found: %v", game.name, id, err)
+			continue
+		}
+		player.stats.merge(game.tallies[id], game.placement(id))
+		participants = append(participants, player)
+	}
+
+	rated := game.rated(participants)
+	if rated {
+		rateGame(game, participants, srv.now)
+	} else {
+		log.Printf("game [%s] is not rated", game.name)
+	}
+
+	for _, player := range participants {
+		if err := srv.store.PutPlayer(player); err != nil {
+			log.Printf("game [%s] save stats of player [%s] failed: %v", game.name, player.name, err)
+		}
+	}
+
+	archive := newGameArchive(game, participants, rated, srv.now)
+	if err := srv.store.PutArchive(archive); err != nil {
+		log.Printf("archive game [%s] failed: %v", game.name, err)
+	}
+	summary := *archive
+	summary.Moves = nil
+	srv.publish(EventGameFinished, game.id, "", summary)
+}
+
+func (srv *server) PlayerStats(playerId string) (PlayerStats, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	player, err := srv.findPlayerById(playerId)
+	if err != nil {
+		return PlayerStats{}, err
+	}
+	return player.stats.clone(), nil
 }
 
-func (srv *server) CleanUpFinishedGame() int {
+// Leaderboard ranks players by their finished games, live games don't
+// count until they finish. The all-time window uses every player's lifetime
+// stats and rating, the weekly one the archived games, which the retention
+// keeps for at least a week.
+func (srv *server) Leaderboard(query LeaderboardQuery) (Leaderboard, error) {
+	since, err := query.normalize(time.Now())
+	if err != nil {
+		return Leaderboard{}, err
+	}
+
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	if query.Window == WindowAllTime {
+		players, err := srv.store.ListPlayers()
+		if err != nil {
+			return Leaderboard{}, err
+		}
+		return rankLeaderboard(playerTallies(players), query), nil
+	}
+
+	archives, err := srv.store.ListArchives()
+	if err != nil {
+		return Leaderboard{}, err
+	}
+	return rankLeaderboard(archiveTallies(archives, since), query), nil
+}
+
+// EnablePersistence restores the server from the latest snapshot in dataDir,
+// replays the command log on top of it, and from then on appends every
+// mutating call to the command log before acknowledging it.
+func (srv *server) EnablePersistence(dataDir string) error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
-	toBeDeleteGameIndex := make([]int, 0, len(srv.games))
-	for i := len(srv.games) - 1; i >= 0; i-- {
-		if srv.games[i].state == GameFinished {
-			toBeDeleteGameIndex = append(toBeDeleteGameIndex, i)
+	if srv.wal != nil {
+		return errors.New("persistence already enabled")
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	snapshot, err := readSnapshot(filepath.Join(dataDir, snapshotFileName))
+	if err != nil {
+		return err
+	}
+	if err := srv.restore(snapshot); err != nil {
+		return err
+	}
+
+	wal, err := openCommandLog(filepath.Join(dataDir, commandLogFileName))
+	if err != nil {
+		return err
+	}
+	entries, err := wal.entries()
+	if err != nil {
+		_ = wal.close()
+		return err
+	}
+	replayed := 0
+	for i := range entries {
+		// entries up to LogSeq were already in the snapshot, we crashed
+		// after writing the snapshot but before compacting the log
+		if entries[i].Seq <= srv.logSeq {
+			continue
 		}
+		srv.replay(&entries[i])
+		srv.logSeq = entries[i].Seq
+		replayed++
+	}
+	log.Printf("restored %d players, %d games and %d archives from snapshot, replayed %d commands",
+		len(snapshot.Players), len(snapshot.Games), len(snapshot.Archives), replayed)
+
+	srv.dataDir = dataDir
+	srv.wal = wal
+	return nil
+}
+
+// Snapshot writes the whole server state into the data dir and compacts the
+// command log, which is no longer needed to recover that state.
+func (srv *server) Snapshot() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.wal == nil {
+		return nil
 	}
-	count := 0
-	for _, index := range toBeDeleteGameIndex {
-		srv.games = append(srv.games[:index], srv.games[index+1:]...)
-		count++
+
+	players, err := srv.store.ListPlayers()
+	if err != nil {
+		return err
+	}
+	games, err := srv.store.ListGames()
+	if err != nil {
+		return err
+	}
+
+	accounts, err := srv.store.ListAccounts()
+	if err != nil {
+		return err
+	}
+	archives, err := srv.store.ListArchives()
+	if err != nil {
+		return err
+	}
+
+	snapshot := &serverSnapshot{
+		LogSeq:   srv.logSeq,
+		Players:  make([]playerRecord, 0, len(players)),
+		Games:    make([]gameRecord, 0, len(games)),
+		Accounts: make([]accountRecord, 0, len(accounts)),
+		Archives: archives,
+	}
+	for _, player := range players {
+		snapshot.Players = append(snapshot.Players, player.record())
+	}
+	for _, game := range games {
+		snapshot.Games = append(snapshot.Games, game.record())
+	}
+	for _, account := range accounts {
+		snapshot.Accounts = append(snapshot.Accounts, account.record())
+	}
+
+	if err := writeSnapshot(filepath.Join(srv.dataDir, snapshotFileName), snapshot); err != nil {
+		return err
+	}
+	return srv.wal.compact()
+}
+
+// Close releases the command log and the store, the server must not be used
+// afterwards.
+func (srv *server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.wal != nil {
+		if err := srv.wal.close(); err != nil {
+			log.Printf("close command log failed: %v", err)
+		}
+		srv.wal = nil
+	}
+	srv.events.close()
+	return srv.store.Close()
+}
+
+func (srv *server) restore(snapshot *serverSnapshot) error {
+	for _, record := range snapshot.Players {
+		if err := srv.store.PutPlayer(record.restore()); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range snapshot.Games {
+		game, err := record.restore(srv.findPlayerById)
+		if err != nil {
+			return err
+		}
+		if err := srv.store.PutGame(game); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range snapshot.Accounts {
+		if err := srv.store.PutAccount(record.restore()); err != nil {
+			return err
+		}
+	}
+
+	for _, archive := range snapshot.Archives {
+		if err := srv.store.PutArchive(archive); err != nil {
+			return err
+		}
+	}
+	srv.logSeq = snapshot.LogSeq
+	return nil
+}
+
+func (srv *server) logCommand(entry *logEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	srv.now = entry.Time
+
+	if srv.wal == nil {
+		return nil
+	}
+	entry.Seq = srv.logSeq + 1
+	if err := srv.wal.append(entry); err != nil {
+		return err
+	}
+	srv.logSeq = entry.Seq
+	return nil
+}
+
+// checkVersion fails with ErrVersionMismatch if ifVersion is set and the
+// game is at another one, or gone. The commands check it under srv.mu
+// before logging, so the game can't change in between.
+func (srv *server) checkVersion(gameId string, ifVersion *uint64) error {
+	if ifVersion == nil {
+		return nil
+	}
+	game, err := srv.findGameById(gameId)
+	if err != nil {
+		return ErrVersionMismatch
+	}
+	if game.version != *ifVersion {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// replay applies one command from the log. Errors are part of the game
+// (ErrLose, ErrWin, ...) and were already reported to the client the first
+// time.
+func (srv *server) replay(entry *logEntry) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("replayed command log entry %d [%s] panicked: %v", entry.Seq, entry.Op, r)
+		}
+	}()
+
+	srv.now = entry.Time
+	if err := srv.apply(entry); err != nil {
+		log.Printf("replayed command log entry %d [%s]: %v", entry.Seq, entry.Op, err)
+	}
+}
+
+// execute logs a command the server issues on its own, e.g. games formed by
+// matchmaking, and applies it.
+func (srv *server) execute(entry *logEntry) error {
+	if err := srv.logCommand(entry); err != nil {
+		return err
+	}
+	return srv.apply(entry)
+}
+
+func (srv *server) apply(entry *logEntry) error {
+	switch entry.Op {
+	case opNewPlayer:
+		_, err := srv.newPlayer(entry.Id, entry.Name, entry.Token, entry.Bot)
+		return err
+	case opNewGame:
+		_, err := srv.newGame(entry)
+		return err
+	case opJoinGame:
+		return srv.joinGame(entry.GameId, entry.PlayerId)
+	case opLeaveGame:
+		return srv.leaveGame(entry.GameId, entry.PlayerId)
+	case opStartGame:
+		return srv.startGame(entry.GameId, entry.PlayerId)
+	case opPlayCard:
+		return srv.playCard(entry.GameId, entry.PlayerId, entry.CardIndex, entry.CardOption)
+	case opRegister:
+		_, err := srv.register(entry.Id, entry.Name, entry.Password)
+		return err
+	case opCleanUp:
+		srv.cleanUpGames()
+		return nil
+	case opSpectate:
+		return srv.spectate(entry.GameId, entry.PlayerId)
+	case opUnspectate:
+		return srv.unspectate(entry.GameId, entry.PlayerId)
+	case opChat:
+		return srv.postChat(entry.GameId, entry.PlayerId, entry.Text)
+	case opInviteCode:
+		return srv.setInviteCode(entry.GameId, entry.PlayerId, entry.Text)
+	case opInvite:
+		return srv.invite(entry.GameId, entry.Id, entry.PlayerId)
+	case opDecline:
+		return srv.declineInvitation(entry.GameId, entry.PlayerId)
+	case opSkipTurn:
+		return srv.skipTurn(entry.GameId, entry.PlayerId)
+	case opForfeit:
+		return srv.forfeit(entry.GameId, entry.PlayerId)
+	case opForceEnd:
+		return srv.forceEndGame(entry.GameId, entry.Text)
+	case opPause:
+		return srv.pauseGame(entry.GameId, true)
+	case opResume:
+		return srv.pauseGame(entry.GameId, false)
+	case opKick:
+		return srv.kickPlayer(entry.GameId, entry.PlayerId)
+	case opResetPlayer:
+		return srv.resetPlayer(entry.PlayerId)
+	case opBroadcast:
+		_, err := srv.broadcast(entry.Text)
+		return err
+	default:
+		return fmt.Errorf("unknown op [%s]", entry.Op)
 	}
-	return count
 }
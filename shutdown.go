@@ -0,0 +1,56 @@
+package dl99
+
+import (
+	"errors"
+	"log"
+)
+
+var (
+	ErrServerDraining = errors.New("server shutting down, no new games")
+)
+
+// ServerStatus counts what the server holds, e.g. for a shutdown summary.
+type ServerStatus struct {
+	Players      int  `json:"players"`
+	Games        int  `json:"games"`
+	RunningGames int  `json:"running_games"`
+	Draining     bool `json:"draining"`
+}
+
+// Drain stops the server from creating games, by NewGame or matchmaking,
+// games already there keep going. It can't be undone.
+func (srv *server) Drain() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.draining {
+		log.Println("draining, no new games")
+	}
+	srv.draining = true
+}
+
+func (srv *server) Status() (ServerStatus, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	players, err := srv.store.ListPlayers()
+	if err != nil {
+		return ServerStatus{}, err
+	}
+	games, err := srv.store.ListGames()
+	if err != nil {
+		return ServerStatus{}, err
+	}
+
+	status := ServerStatus{
+		Players:  len(players),
+		Games:    len(games),
+		Draining: srv.draining,
+	}
+	for _, game := range games {
+		if game.state == GameStarted {
+			status.RunningGames++
+		}
+	}
+	return status, nil
+}
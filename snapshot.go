@@ -0,0 +1,232 @@
+package dl99
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFileName   = "snapshot.json"
+	commandLogFileName = "commands.log"
+)
+
+type playerRecord struct {
+	Id      string      `json:"id"`
+	Name    string      `json:"name"`
+	GameId  string      `json:"game_id"`
+	Hand    []Card      `json:"hand"`
+	Token   string      `json:"token"`
+	Account string      `json:"account,omitempty"`
+	Stats   PlayerStats `json:"stats"`
+
+	Bot           bool           `json:"bot,omitempty"`
+	Rating        float64        `json:"rating"`
+	RatingHistory []RatingChange `json:"rating_history"`
+}
+
+type gameRecord struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	PlayerIds    []string `json:"player_ids"`
+	Score        int      `json:"score"`
+	NextPlayerId string   `json:"next_player_id"`
+	State        int      `json:"state"`
+	Seed         int64    `json:"seed"`
+	Draws        uint64   `json:"draws"`
+	Deck         []Card   `json:"deck"`
+	Deadwood     []Card   `json:"deadwood"`
+	Clockwise    bool     `json:"clockwise"`
+
+	Participants []string              `json:"participants"`
+	Standings    []string              `json:"standings"`
+	Tallies      map[string]*gameTally `json:"tallies"`
+
+	Spectators []string `json:"spectators"`
+	Chat       *chatLog `json:"chat"`
+
+	HostId       string   `json:"host_id,omitempty"`
+	Private      bool     `json:"private,omitempty"`
+	InviteCode   string   `json:"invite_code,omitempty"`
+	PasswordHash []byte   `json:"password_hash,omitempty"`
+	Invitations  []string `json:"invitations,omitempty"`
+
+	Moves     []Move    `json:"moves"`
+	StartedAt time.Time `json:"started_at"`
+	ActiveAt  time.Time `json:"active_at"`
+	Paused    bool      `json:"paused,omitempty"`
+	Version   uint64    `json:"version"`
+}
+
+type serverSnapshot struct {
+	// the last command log entry already applied to this snapshot
+	LogSeq   uint64          `json:"log_seq"`
+	Players  []playerRecord  `json:"players"`
+	Games    []gameRecord    `json:"games"`
+	Accounts []accountRecord `json:"accounts"`
+	// the commands that finished these games may be compacted away
+	Archives []*GameArchive `json:"archives"`
+}
+
+func (player *player) record() playerRecord {
+	return playerRecord{
+		Id:      player.id,
+		Name:    player.name,
+		GameId:  player.gameId,
+		Hand:    append([]Card(nil), player.hand...),
+		Token:   player.token,
+		Account: player.account,
+		Stats:   player.stats,
+
+		Bot:           player.bot,
+		Rating:        player.rating,
+		RatingHistory: player.ratingHistory,
+	}
+}
+
+func (record playerRecord) restore() *player {
+	// records written before ratings existed
+	if record.Rating == 0 {
+		record.Rating = initialRating
+	}
+	return &player{
+		id:      record.Id,
+		name:    record.Name,
+		gameId:  record.GameId,
+		hand:    record.Hand,
+		token:   record.Token,
+		account: record.Account,
+		stats:   record.Stats,
+
+		bot:           record.Bot,
+		rating:        record.Rating,
+		ratingHistory: record.RatingHistory,
+	}
+}
+
+func (game *freeBattleGame) record() gameRecord {
+	playerIds := make([]string, 0, len(game.players))
+	for _, player := range game.players {
+		playerIds = append(playerIds, player.id)
+	}
+	return gameRecord{
+		Id:           game.id,
+		Name:         game.name,
+		PlayerIds:    playerIds,
+		Score:        game.score,
+		NextPlayerId: game.nextPlayerId,
+		State:        game.state,
+		Seed:         game.source.seed,
+		Draws:        game.source.draws,
+		Deck:         append([]Card(nil), game.deck...),
+		Deadwood:     append([]Card(nil), game.deadwood...),
+		Clockwise:    game.clockwise,
+		Participants: game.participants,
+		Standings:    game.standings,
+		Tallies:      game.tallies,
+		Spectators:   game.spectators,
+		Chat:         game.chat,
+		HostId:       game.hostId,
+		Private:      game.private,
+		InviteCode:   game.inviteCode,
+		PasswordHash: game.passwordHash,
+		Invitations:  game.invitations,
+		Moves:        game.moves,
+		StartedAt:    game.startedAt,
+		ActiveAt:     game.activeAt,
+		Paused:       game.paused,
+		Version:      game.version,
+	}
+}
+
+// restore rebuilds a game, players are looked up by id so the game shares
+// the same player objects as the server.
+func (record gameRecord) restore(findPlayer func(id string) (*player, error)) (*freeBattleGame, error) {
+	players := make([]*player, 0, len(record.PlayerIds))
+	for _, id := range record.PlayerIds {
+		player, err := findPlayer(id)
+		if err != nil {
+			return nil, err
+		}
+		players = append(players, player)
+	}
+	if record.Chat == nil {
+		record.Chat = newChatLog()
+	}
+	source := newCountingSource(record.Seed, record.Draws)
+	return &freeBattleGame{
+		mu:           &sync.Mutex{},
+		id:           record.Id,
+		name:         record.Name,
+		players:      players,
+		score:        record.Score,
+		nextPlayerId: record.NextPlayerId,
+		state:        record.State,
+		source:       source,
+		rng:          rand.New(source),
+		deck:         record.Deck,
+		deadwood:     record.Deadwood,
+		clockwise:    record.Clockwise,
+		participants: record.Participants,
+		standings:    record.Standings,
+		tallies:      record.Tallies,
+		spectators:   record.Spectators,
+		chat:         record.Chat,
+		hostId:       record.HostId,
+		private:      record.Private,
+		inviteCode:   record.InviteCode,
+		passwordHash: record.PasswordHash,
+		invitations:  record.Invitations,
+		moves:        record.Moves,
+		startedAt:    record.StartedAt,
+		activeAt:     record.ActiveAt,
+		paused:       record.Paused,
+		version:      record.Version,
+	}, nil
+}
+
+func readSnapshot(path string) (*serverSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &serverSnapshot{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snapshot serverSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// writeSnapshot replaces the snapshot file atomically, so a crash leaves
+// either the old or the new snapshot, never a partial one.
+func writeSnapshot(path string, snapshot *serverSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), snapshotFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,102 @@
+package dl99
+
+// PlayerStats are a player's lifetime statistics, updated every time a game
+// the player was dealt into finishes.
+type PlayerStats struct {
+	GamesPlayed int `json:"games_played"`
+	Wins        int `json:"wins"`
+
+	// placement -> games, 1 is the winner
+	Placements map[int]int `json:"placements"`
+
+	// times the player pushed the score beyond the deadline
+	Busts int `json:"busts"`
+
+	// rank name -> busts caused by playing that rank
+	BustRanks map[string]int `json:"bust_ranks"`
+
+	// rank name -> cards played
+	CardsPlayed map[string]int `json:"cards_played"`
+
+	// the score on the table each time it was the player's turn
+	TurnScoreSum     int     `json:"turn_score_sum"`
+	Turns            int     `json:"turns"`
+	AverageTurnScore float64 `json:"average_turn_score"`
+}
+
+func newPlayerStats() PlayerStats {
+	return PlayerStats{
+		Placements:  make(map[int]int),
+		BustRanks:   make(map[string]int),
+		CardsPlayed: make(map[string]int),
+	}
+}
+
+func (stats PlayerStats) clone() PlayerStats {
+	clone := stats
+	clone.Placements = make(map[int]int, len(stats.Placements))
+	for k, v := range stats.Placements {
+		clone.Placements[k] = v
+	}
+	clone.BustRanks = make(map[string]int, len(stats.BustRanks))
+	for k, v := range stats.BustRanks {
+		clone.BustRanks[k] = v
+	}
+	clone.CardsPlayed = make(map[string]int, len(stats.CardsPlayed))
+	for k, v := range stats.CardsPlayed {
+		clone.CardsPlayed[k] = v
+	}
+	return clone
+}
+
+// gameTally is what one player did during one game, merged into
+// PlayerStats when the game finishes.
+type gameTally struct {
+	CardsPlayed  map[Rank]int `json:"cards_played"`
+	TurnScoreSum int          `json:"turn_score_sum"`
+	Turns        int          `json:"turns"`
+
+	// NoRank unless the player busted
+	BustRank Rank `json:"bust_rank"`
+}
+
+func newGameTally() *gameTally {
+	return &gameTally{
+		CardsPlayed: make(map[Rank]int),
+	}
+}
+
+func (tally *gameTally) played(card Card, score int) {
+	tally.CardsPlayed[card.Rank()]++
+	tally.TurnScoreSum += score
+	tally.Turns++
+}
+
+// merge adds one finished game to the stats, placement 1 is the winner.
+func (stats *PlayerStats) merge(tally *gameTally, placement int) {
+	if stats.Placements == nil {
+		*stats = newPlayerStats()
+	}
+
+	stats.GamesPlayed++
+	stats.Placements[placement]++
+	if placement == 1 {
+		stats.Wins++
+	}
+
+	if tally == nil {
+		return
+	}
+	if tally.BustRank != NoRank {
+		stats.Busts++
+		stats.BustRanks[tally.BustRank.Name()]++
+	}
+	for rank, count := range tally.CardsPlayed {
+		stats.CardsPlayed[rank.Name()] += count
+	}
+	stats.TurnScoreSum += tally.TurnScoreSum
+	stats.Turns += tally.Turns
+	if stats.Turns > 0 {
+		stats.AverageTurnScore = float64(stats.TurnScoreSum) / float64(stats.Turns)
+	}
+}
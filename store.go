@@ -0,0 +1,197 @@
+package dl99
+
+import (
+	"errors"
+)
+
+var (
+	ErrArchiveNotFound = errors.New("archive not found")
+)
+
+// Store keeps players, games, finished-game archives and accounts for the
+// server.
+//
+// Players and games are live objects: the server mutates what Get returns
+// and calls Put afterwards, so a Store writing to disk can persist the new
+// state. Stores don't lock, the server serializes access with its own lock.
+type Store interface {
+	GetPlayer(id string) (*player, error)
+	PutPlayer(player *player) error
+	ListPlayers() ([]*player, error)
+	DeletePlayer(id string) error
+
+	GetGame(id string) (*freeBattleGame, error)
+	PutGame(game *freeBattleGame) error
+	ListGames() ([]*freeBattleGame, error)
+	DeleteGame(id string) error
+
+	GetArchive(id string) (*GameArchive, error)
+	PutArchive(archive *GameArchive) error
+	ListArchives() ([]*GameArchive, error)
+	DeleteArchive(id string) error
+
+	GetAccount(username string) (*account, error)
+	PutAccount(account *account) error
+	ListAccounts() ([]*account, error)
+	DeleteAccount(username string) error
+
+	Close() error
+}
+
+type memoryStore struct {
+	players  []*player
+	games    []*freeBattleGame
+	archives []*GameArchive
+	accounts []*account
+}
+
+// NewMemoryStore returns a Store keeping everything in memory, all of it is
+// lost when the process exits unless persistence is enabled on the server.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		players:  make([]*player, 0),
+		games:    make([]*freeBattleGame, 0),
+		archives: make([]*GameArchive, 0),
+		accounts: make([]*account, 0),
+	}
+}
+
+func (store *memoryStore) GetPlayer(id string) (*player, error) {
+	for _, player := range store.players {
+		if player.id == id {
+			return player, nil
+		}
+	}
+	return nil, ErrPlayerNotFound
+}
+
+func (store *memoryStore) PutPlayer(player *player) error {
+	for i := range store.players {
+		if store.players[i].id == player.id {
+			store.players[i] = player
+			return nil
+		}
+	}
+	store.players = append(store.players, player)
+	return nil
+}
+
+func (store *memoryStore) ListPlayers() ([]*player, error) {
+	return append([]*player(nil), store.players...), nil
+}
+
+func (store *memoryStore) DeletePlayer(id string) error {
+	for i := range store.players {
+		if store.players[i].id == id {
+			store.players = append(store.players[:i], store.players[i+1:]...)
+			return nil
+		}
+	}
+	return ErrPlayerNotFound
+}
+
+func (store *memoryStore) GetGame(id string) (*freeBattleGame, error) {
+	for _, game := range store.games {
+		if game.id == id {
+			return game, nil
+		}
+	}
+	return nil, ErrGameNotFound
+}
+
+func (store *memoryStore) PutGame(game *freeBattleGame) error {
+	for i := range store.games {
+		if store.games[i].id == game.id {
+			store.games[i] = game
+			return nil
+		}
+	}
+	store.games = append(store.games, game)
+	return nil
+}
+
+func (store *memoryStore) ListGames() ([]*freeBattleGame, error) {
+	return append([]*freeBattleGame(nil), store.games...), nil
+}
+
+func (store *memoryStore) DeleteGame(id string) error {
+	for i := range store.games {
+		if store.games[i].id == id {
+			store.games = append(store.games[:i], store.games[i+1:]...)
+			return nil
+		}
+	}
+	return ErrGameNotFound
+}
+
+func (store *memoryStore) GetArchive(id string) (*GameArchive, error) {
+	for _, archive := range store.archives {
+		if archive.Id == id {
+			return archive, nil
+		}
+	}
+	return nil, ErrArchiveNotFound
+}
+
+func (store *memoryStore) PutArchive(archive *GameArchive) error {
+	for i := range store.archives {
+		if store.archives[i].Id == archive.Id {
+			store.archives[i] = archive
+			return nil
+		}
+	}
+	store.archives = append(store.archives, archive)
+	return nil
+}
+
+func (store *memoryStore) ListArchives() ([]*GameArchive, error) {
+	return append([]*GameArchive(nil), store.archives...), nil
+}
+
+func (store *memoryStore) DeleteArchive(id string) error {
+	for i := range store.archives {
+		if store.archives[i].Id == id {
+			store.archives = append(store.archives[:i], store.archives[i+1:]...)
+			return nil
+		}
+	}
+	return ErrArchiveNotFound
+}
+
+func (store *memoryStore) GetAccount(username string) (*account, error) {
+	for _, account := range store.accounts {
+		if account.username == username {
+			return account, nil
+		}
+	}
+	return nil, ErrAccountNotFound
+}
+
+func (store *memoryStore) PutAccount(account *account) error {
+	for i := range store.accounts {
+		if store.accounts[i].username == account.username {
+			store.accounts[i] = account
+			return nil
+		}
+	}
+	store.accounts = append(store.accounts, account)
+	return nil
+}
+
+func (store *memoryStore) ListAccounts() ([]*account, error) {
+	return append([]*account(nil), store.accounts...), nil
+}
+
+func (store *memoryStore) DeleteAccount(username string) error {
+	for i := range store.accounts {
+		if store.accounts[i].username == username {
+			store.accounts = append(store.accounts[:i], store.accounts[i+1:]...)
+			return nil
+		}
+	}
+	return ErrAccountNotFound
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
@@ -1,6 +1,8 @@
 package dl99
 
 import (
+	crand "crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"math/rand"
@@ -8,8 +10,7 @@ import (
 )
 
 // Fisher-Yates
-func shuffle(cards []Card) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+func shuffle(rng *rand.Rand, cards []Card) {
 	var i, j int
 	for i = 0; i < len(cards); i++ {
 		j = rng.Intn(len(cards)-i) + i
@@ -26,3 +27,47 @@ func randomId(prefix string) string {
 	rng.Read(buf[8:])
 	return prefix + hex.EncodeToString(buf)
 }
+
+// 32 bytes from crypto/rand, ids are guessable but tokens must not be
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := crand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// countingSource wraps a seeded rand.Source and counts how many values have
+// been drawn from it, so that a game's random state can be saved as
+// (seed, draws) and restored later by replaying the same number of draws.
+type countingSource struct {
+	src   rand.Source
+	seed  int64
+	draws uint64
+}
+
+func newCountingSource(seed int64, draws uint64) *countingSource {
+	s := &countingSource{
+		src:  rand.NewSource(seed),
+		seed: seed,
+	}
+	for s.draws < draws {
+		s.Int63()
+	}
+	return s
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.src.Int63()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.src.Seed(seed)
+	s.seed = seed
+	s.draws = 0
+}
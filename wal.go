@@ -0,0 +1,138 @@
+package dl99
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	opNewPlayer  = "new_player"
+	opNewGame    = "new_game"
+	opJoinGame   = "join_game"
+	opLeaveGame  = "leave_game"
+	opStartGame  = "start_game"
+	opPlayCard   = "play_card"
+	opCleanUp    = "clean_up"
+	opRegister   = "register"
+	opSpectate   = "spectate"
+	opUnspectate = "unspectate"
+	opChat       = "chat"
+	opInviteCode = "invite_code"
+	opInvite     = "invite"
+	opDecline    = "decline"
+	opSkipTurn   = "skip_turn"
+	opForfeit    = "forfeit"
+
+	// admin
+	opForceEnd    = "force_end"
+	opPause       = "pause"
+	opResume      = "resume"
+	opKick        = "kick"
+	opResetPlayer = "reset_player"
+	opBroadcast   = "broadcast"
+)
+
+// logEntry is one mutating server call. Everything that is random at the
+// time of the call (generated ids, game seeds, password hashes, the time
+// itself) is recorded in the entry, so replaying the log on top of a
+// snapshot rebuilds exactly the same state.
+type logEntry struct {
+	Seq        uint64      `json:"seq"`
+	Op         string      `json:"op"`
+	Id         string      `json:"id,omitempty"`
+	Name       string      `json:"name,omitempty"`
+	Token      string      `json:"token,omitempty"`
+	Bot        bool        `json:"bot,omitempty"`
+	Password   []byte      `json:"password,omitempty"`
+	Time       time.Time   `json:"time,omitempty"`
+	Seed       int64       `json:"seed,omitempty"`
+	Private    bool        `json:"private,omitempty"`
+	GameId     string      `json:"game_id,omitempty"`
+	PlayerId   string      `json:"player_id,omitempty"`
+	CardIndex  int         `json:"card_index,omitempty"`
+	CardOption *CardOption `json:"card_option,omitempty"`
+	Text       string      `json:"text,omitempty"`
+}
+
+// commandLog is an append-only file of JSON encoded logEntry, one per line.
+// Every append is fsync'd before it returns.
+type commandLog struct {
+	path string
+	file *os.File
+}
+
+func openCommandLog(path string) (*commandLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &commandLog{path: path, file: file}, nil
+}
+
+// entries reads all complete entries in the log. A torn last line, which is
+// what a crash in the middle of an append leaves behind, is cut off so that
+// later appends start on a clean line.
+func (wal *commandLog) entries() ([]logEntry, error) {
+	if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := make([]logEntry, 0)
+	reader := bufio.NewReader(wal.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("command log [%s] has a torn entry at offset %d, dropped", wal.path, offset)
+				if err := wal.file.Truncate(offset); err != nil {
+					return nil, err
+				}
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("command log [%s] has a broken entry at offset %d, dropped the rest", wal.path, offset)
+			if err := wal.file.Truncate(offset); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		}
+		entries = append(entries, entry)
+		offset += int64(len(line))
+	}
+}
+
+func (wal *commandLog) append(entry *logEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := wal.file.Write(data); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// compact drops every entry, called once a snapshot covering them is safely
+// on disk.
+func (wal *commandLog) compact() error {
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+func (wal *commandLog) close() error {
+	return wal.file.Close()
+}
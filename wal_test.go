@@ -0,0 +1,262 @@
+package dl99
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// openServer opens a server persisting into dataDir.
+func openServer(t *testing.T, dataDir string) *server {
+	srv := NewServer(0, 0, nil)
+	if err := srv.EnablePersistence(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// crash drops the server the way a killed process would, without a
+// snapshot.
+func crash(t *testing.T, srv *server) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if err := srv.wal.close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.wal = nil
+}
+
+// playGame starts a game of three and plays moves cards, returning the game
+// id.
+func playGame(t *testing.T, srv *server, moves int) string {
+	playerIds := make([]string, 0, 3)
+	for _, name := range []string{"a", "b", "c"} {
+		id, _, err := srv.NewPlayer(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		playerIds = append(playerIds, id)
+	}
+	gameId, err := srv.NewGame("recovery", GameOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range playerIds {
+		if err := srv.JoinGame(gameId, id, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.StartGame(gameId, playerIds[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	playMoves(t, srv, gameId, moves)
+	return gameId
+}
+
+// playMoves plays moves cards, or until the game finishes.
+func playMoves(t *testing.T, srv *server, gameId string, moves int) {
+	for i := 0; i < moves; i++ {
+		game, err := srv.GameInfo(gameId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if game.State != GameStarted {
+			break
+		}
+		// aim every card at some other player still in the game, with cards
+		// left for a jack to take
+		var target string
+		for _, player := range game.Players {
+			if player.Id != game.NextPlayerId && player.HandCardCount > 0 {
+				target = player.Id
+			}
+		}
+		option := &CardOption{
+			RankAceChangeNextPlayer:       target,
+			RankJackDrawOneCardFromPlayer: target,
+			Rank7ChangeAllHandToPlayer:    target,
+		}
+		err = srv.PlayCard(gameId, game.NextPlayerId, 0, option, nil)
+		if err != nil && err != ErrWin && err != ErrLose {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serverState is every player and game as they'd be snapshotted, sorted by
+// id.
+func serverState(t *testing.T, srv *server) string {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	players, err := srv.store.ListPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	games, err := srv.store.ListGames()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := struct {
+		Players []playerRecord
+		Games   []gameRecord
+	}{}
+	for _, player := range players {
+		state.Players = append(state.Players, player.record())
+	}
+	for _, game := range games {
+		state.Games = append(state.Games, game.record())
+	}
+	sort.Slice(state.Players, func(i, j int) bool { return state.Players[i].Id < state.Players[j].Id })
+	sort.Slice(state.Games, func(i, j int) bool { return state.Games[i].Id < state.Games[j].Id })
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dl99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestRecoverFromCommandLog(t *testing.T) {
+	dir := tempDir(t)
+	srv := openServer(t, dir)
+	gameId := playGame(t, srv, 10)
+	before := serverState(t, srv)
+	crash(t, srv)
+
+	srv = openServer(t, dir)
+	defer srv.Close()
+	if after := serverState(t, srv); after != before {
+		t.Fatalf("state after replay differs\nbefore: %s\nafter:  %s", before, after)
+	}
+	if _, err := srv.GameInfo(gameId); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPersistenceCreatesDataDir(t *testing.T) {
+	dir := filepath.Join(tempDir(t), "data", "dl99")
+	srv := openServer(t, dir)
+	defer srv.Close()
+	if _, _, err := srv.NewPlayer("a", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, commandLogFileName)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverFromTornCommandLog(t *testing.T) {
+	dir := tempDir(t)
+	srv := openServer(t, dir)
+	playGame(t, srv, 10)
+	before := serverState(t, srv)
+	crash(t, srv)
+
+	// the process died in the middle of appending an entry
+	path := filepath.Join(dir, commandLogFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"seq":1000,"op":"play_ca`); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv = openServer(t, dir)
+	if after := serverState(t, srv); after != before {
+		t.Fatalf("state after replay differs\nbefore: %s\nafter:  %s", before, after)
+	}
+
+	// the torn entry is gone, so what's appended next is read back
+	if _, _, err := srv.NewPlayer("d", false); err != nil {
+		t.Fatal(err)
+	}
+	before = serverState(t, srv)
+	crash(t, srv)
+
+	srv = openServer(t, dir)
+	defer srv.Close()
+	if after := serverState(t, srv); after != before {
+		t.Fatalf("state after second replay differs\nbefore: %s\nafter:  %s", before, after)
+	}
+}
+
+func TestRecoverBetweenSnapshotAndCompaction(t *testing.T) {
+	dir := tempDir(t)
+	srv := openServer(t, dir)
+	gameId := playGame(t, srv, 0)
+	if err := srv.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// the log now has commands the next snapshot has too, replaying them
+	// again would post the message twice. Posted before any move, some
+	// seeds finish the game within a few.
+	game, err := srv.GameInfo(gameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.PostChat(gameId, game.Players[0].Id, "good game"); err != nil {
+		t.Fatal(err)
+	}
+	playMoves(t, srv, gameId, 10)
+	before := serverState(t, srv)
+
+	// keep the log as it was before Snapshot compacted it, as if the
+	// process died right after writing the snapshot
+	path := filepath.Join(dir, commandLogFileName)
+	entries, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, srv)
+	if err := ioutil.WriteFile(path, entries, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv = openServer(t, dir)
+	defer srv.Close()
+	if after := serverState(t, srv); after != before {
+		t.Fatalf("state after replay differs\nbefore: %s\nafter:  %s", before, after)
+	}
+}
+
+func TestRecoverArchivesAfterCompaction(t *testing.T) {
+	dir := tempDir(t)
+	srv := openServer(t, dir)
+	gameId := playGame(t, srv, 1000)
+	if _, err := srv.GameArchive(gameId); err != nil {
+		t.Fatal(err)
+	}
+	// the commands that finished the game are gone after this
+	if err := srv.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, srv)
+
+	srv = openServer(t, dir)
+	defer srv.Close()
+	if _, err := srv.GameArchive(gameId); err != nil {
+		t.Fatalf("archive lost after compaction: %v", err)
+	}
+}